@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kothar/go-backblaze"
+)
+
+const (
+	b2APIHost = "api.backblazeb2.com"
+	b2Host    = "https://" + b2APIHost
+	b2API     = "/b2api/v2/"
+)
+
+// apiClient makes the B2 API calls that go-backblaze doesn't provide. It keeps
+// its own authorization, since go-backblaze doesn't share its token.
+type apiClient struct {
+	accountID   string
+	apiURL      string
+	downloadURL string
+	s3URL       string
+	token       string
+	allowed     allowed
+	// The part size B2 recommends for large files.
+	partSize int64
+}
+
+type authorizeAccountResponse struct {
+	AccountID           string  `json:"accountId"`
+	APIURL              string  `json:"apiUrl"`
+	AuthorizationToken  string  `json:"authorizationToken"`
+	DownloadURL         string  `json:"downloadUrl"`
+	S3APIURL            string  `json:"s3ApiUrl"`
+	Allowed             allowed `json:"allowed"`
+	RecommendedPartSize int64   `json:"recommendedPartSize"`
+}
+
+// allowed describes what an application key is restricted to.
+type allowed struct {
+	BucketID     string   `json:"bucketId"`
+	BucketName   string   `json:"bucketName"`
+	Capabilities []string `json:"capabilities"`
+	NamePrefix   string   `json:"namePrefix"`
+}
+
+func (a *allowed) can(capability string) bool {
+	for _, c := range a.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// check makes sure that the remote's settings are within what the key is
+// allowed to do. Unless the bucket is cached, it has to be listed.
+func (a *allowed) check(config *configValues, listing bool) error {
+	if listing && !a.can("listBuckets") {
+		return errors.New("the application key needs the listBuckets capability")
+	}
+
+	if a.BucketID != "" {
+		if (config.bucketID != "" && config.bucketID != a.BucketID) || (config.bucketName != "" && config.bucketName != a.BucketName) {
+			return fmt.Errorf("the application key only has access to bucket %#v", a.BucketName)
+		}
+	}
+
+	if !strings.HasPrefix(config.prefix, a.NamePrefix) {
+		return fmt.Errorf("the application key only has access to names starting with %#v, set prefix=%v", a.NamePrefix, a.NamePrefix)
+	}
+
+	return nil
+}
+
+func authorizeAPI(creds backblaze.Credentials) (*apiClient, error) {
+	req, err := http.NewRequest("GET", b2Host+b2API+"b2_authorize_account", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID := creds.KeyID
+	if keyID == "" {
+		keyID = creds.AccountID
+	}
+	req.SetBasicAuth(keyID, creds.ApplicationKey)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, transient(err)
+	}
+
+	response := &authorizeAccountResponse{}
+	err = parseResponse(resp, response)
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiClient{
+		accountID:   response.AccountID,
+		apiURL:      response.APIURL,
+		downloadURL: response.DownloadURL,
+		s3URL:       response.S3APIURL,
+		token:       response.AuthorizationToken,
+		allowed:     response.Allowed,
+		partSize:    response.RecommendedPartSize,
+	}, nil
+}
+
+// call posts request to the named API endpoint and decodes the reply into
+// response.
+func (api *apiClient) call(name string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", api.apiURL+b2API+name, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", api.token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return transient(err)
+	}
+
+	return parseResponse(resp, response)
+}
+
+// api returns a client for calls that go-backblaze can't make, authorizing
+// it on first use. Nothing is locked while authorizing, so that other jobs
+// needn't wait on B2 for a client when one is already there; if several
+// authorize at once, the first client published is kept.
+func (be *B2Ext) api() (*apiClient, error) {
+	be.apiMu.Lock()
+	api := be.apiClient
+	be.apiMu.Unlock()
+	if api != nil {
+		return api, nil
+	}
+
+	be.authMu.Lock()
+	creds := be.b2.Credentials
+	be.authMu.Unlock()
+
+	api, err := authorizeAPI(creds)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't authorize: %v", err)
+	}
+
+	be.apiMu.Lock()
+	defer be.apiMu.Unlock()
+	if be.apiClient == nil {
+		be.apiClient = api
+	}
+	return be.apiClient, nil
+}
+
+// call makes an API call with the client from api, authorizing it again if
+// its token has expired.
+func (be *B2Ext) call(name string, request, response interface{}) error {
+	for i := 0; ; i++ {
+		api, err := be.api()
+		if err != nil {
+			return err
+		}
+
+		err = api.call(name, request, response)
+		if i > 0 || !isExpiredAuth(err) {
+			return err
+		}
+
+		be.apiMu.Lock()
+		if be.apiClient == api {
+			be.apiClient = nil
+		}
+		be.apiMu.Unlock()
+	}
+}
+
+// reauthorize renews the authorization of both go-backblaze and the API
+// client once B2 has said that it expired, failing over to another
+// application key if the one in use has been revoked.
+func (be *B2Ext) reauthorize() error {
+	be.authMu.Lock()
+	defer be.authMu.Unlock()
+
+	be.apiMu.Lock()
+	be.apiClient = nil
+	be.apiMu.Unlock()
+
+	err := be.b2.AuthorizeAccount()
+	if isUnauthorized(err) {
+		err = be.failover(err)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't authorize: %v", err)
+	}
+	return nil
+}
+
+type listBucketsRequest struct {
+	AccountID  string `json:"accountId"`
+	BucketID   string `json:"bucketId,omitempty"`
+	BucketName string `json:"bucketName,omitempty"`
+}
+
+type listBucketsResponse struct {
+	Buckets []*backblaze.BucketInfo `json:"buckets"`
+}
+
+type listFileVersionsRequest struct {
+	BucketID      string `json:"bucketId"`
+	StartFileName string `json:"startFileName,omitempty"`
+	StartFileID   string `json:"startFileId,omitempty"`
+	MaxFileCount  int    `json:"maxFileCount,omitempty"`
+	Prefix        string `json:"prefix,omitempty"`
+	Delimiter     string `json:"delimiter,omitempty"`
+}
+
+type listFileVersionsResponse struct {
+	Files        []fileVersion `json:"files"`
+	NextFileName string        `json:"nextFileName"`
+	NextFileID   string        `json:"nextFileId"`
+}
+
+// fileVersion is a listed file version along with its Object Lock retention,
+// which go-backblaze leaves out.
+type fileVersion struct {
+	backblaze.FileStatus
+	FileRetention struct {
+		Value *fileRetention `json:"value"`
+	} `json:"fileRetention"`
+}
+
+// listFileVersions is Bucket.ListFileVersions, limited to names under prefix.
+func (be *B2Ext) listFileVersions(startFileName, startFileID string, maxFileCount int, prefix, delimiter string) (*listFileVersionsResponse, error) {
+	response := &listFileVersionsResponse{}
+	err := be.call("b2_list_file_versions", &listFileVersionsRequest{
+		BucketID:      be.bucket().ID,
+		StartFileName: startFileName,
+		StartFileID:   startFileID,
+		MaxFileCount:  maxFileCount,
+		Prefix:        prefix,
+		Delimiter:     delimiter,
+	}, response)
+	return response, err
+}
+
+// listVersions returns every version of name, newest first.
+func (be *B2Ext) listVersions(name string) ([]fileVersion, error) {
+	if be.s3 != nil {
+		// Retention only matters to deleting.
+		versions, err := be.s3.listObjectVersions(name, be.deleteVersions)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't list file versions: %v", err)
+		}
+		return versions, nil
+	}
+
+	var versions []fileVersion
+	startFileID := ""
+	for {
+		response, err := be.listFileVersions(name, startFileID, 100, name, "")
+		if err != nil {
+			return nil, fmt.Errorf("couldn't list file versions: %v", err)
+		}
+
+		for _, file := range response.Files {
+			if file.Name != name {
+				return versions, nil
+			}
+			versions = append(versions, file)
+		}
+
+		if response.NextFileName != name {
+			return versions, nil
+		}
+		startFileID = response.NextFileID
+	}
+}
+
+type cancelLargeFileRequest struct {
+	FileID string `json:"fileId"`
+}
+
+func (be *B2Ext) cancelLargeFile(fileID string) error {
+	return be.call("b2_cancel_large_file", &cancelLargeFileRequest{
+		FileID: fileID,
+	}, &struct{}{})
+}
+
+type updateFileLegalHoldRequest struct {
+	FileName  string `json:"fileName"`
+	FileID    string `json:"fileId"`
+	LegalHold string `json:"legalHold"`
+}
+
+// updateLegalHold places or lifts a legal hold on one version of a file.
+func (be *B2Ext) updateLegalHold(name, fileID string, hold bool) error {
+	legalHold := "off"
+	if hold {
+		legalHold = "on"
+	}
+	return be.call("b2_update_file_legal_hold", &updateFileLegalHoldRequest{
+		FileName:  name,
+		FileID:    fileID,
+		LegalHold: legalHold,
+	}, &struct{}{})
+}
+
+// B2 refuses to authorize downloads for longer than a week.
+const maxDownloadAuthorizationDuration = 7 * 24 * time.Hour
+
+type getDownloadAuthorizationRequest struct {
+	BucketID               string `json:"bucketId"`
+	FileNamePrefix         string `json:"fileNamePrefix"`
+	ValidDurationInSeconds int64  `json:"validDurationInSeconds"`
+}
+
+type getDownloadAuthorizationResponse struct {
+	AuthorizationToken string `json:"authorizationToken"`
+}
+
+// signedURL returns a URL that name can be downloaded from without
+// credentials for the next d, even if the bucket is private.
+func (be *B2Ext) signedURL(name string, d time.Duration) (string, error) {
+	response := &getDownloadAuthorizationResponse{}
+	err := be.call("b2_get_download_authorization", &getDownloadAuthorizationRequest{
+		BucketID:               be.bucket().ID,
+		FileNamePrefix:         name,
+		ValidDurationInSeconds: int64(d / time.Second),
+	}, response)
+	if err != nil {
+		return "", fmt.Errorf("couldn't get download authorization: %v", err)
+	}
+
+	fileURL, err := be.fileURL(name)
+	if err != nil {
+		return "", err
+	}
+	return fileURL + "?Authorization=" + url.QueryEscape(response.AuthorizationToken), nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/arcnmx/go-git-annex-external/external"
+)
+
+// runLoop is external.RunLoop with support for the ASYNC extension.
+//
+// Once ASYNC has been negotiated, git-annex prefixes every line with "J n" to
+// say which job it belongs to. Each job is given its own protocol loop over a
+// pipe, so that as far as the handler is concerned it is just another
+// External, while all of the jobs share the same authorization, bucket and
+// filename cache.
+func runLoop(in io.Reader, out io.Writer, h external.ExternalHandler) error {
+	m := &asyncMux{
+		h:    h,
+		out:  out,
+		jobs: make(map[string]*asyncJob),
+	}
+
+	main := m.start("")
+
+	r := bufio.NewReader(in)
+	for {
+		line, err := r.ReadString('\n')
+		if line != "" {
+			if strings.HasPrefix(line, "J ") {
+				fields := strings.SplitN(line, " ", 3)
+				if len(fields) == 3 {
+					m.job(fields[1]).send(fields[2])
+				}
+			} else {
+				if strings.HasPrefix(line, "EXTENSIONS ") {
+					m.extensions = line
+				}
+				main.send(line)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	for _, job := range m.jobs {
+		job.close()
+	}
+	m.wg.Wait()
+
+	return main.err
+}
+
+type asyncMux struct {
+	h     external.ExternalHandler
+	out   io.Writer
+	outMu sync.Mutex
+	jobs  map[string]*asyncJob
+	wg    sync.WaitGroup
+	// The EXTENSIONS request that git-annex began with, which each job is
+	// given too so that it knows what git-annex supports.
+	extensions string
+}
+
+// asyncJob queues the lines for one job. The queue has no limit, since the
+// reader that fills it is shared by every job and must never wait on one of
+// them.
+type asyncJob struct {
+	mu     sync.Mutex
+	ready  *sync.Cond
+	lines  []string
+	closed bool
+	err    error
+}
+
+func (m *asyncMux) job(id string) *asyncJob {
+	job, ok := m.jobs[id]
+	if !ok {
+		job = m.start(id)
+	}
+	return job
+}
+
+// start runs a protocol loop for the job called id, or for the requests that
+// aren't part of any job if id is empty.
+func (m *asyncMux) start(id string) *asyncJob {
+	job := &asyncJob{}
+	job.ready = sync.NewCond(&job.mu)
+	m.jobs[id] = job
+
+	// Lines are fed to the job's loop as it reads them, so that a job that
+	// is busy with a transfer can't hold up the others.
+	pr, pw := io.Pipe()
+	go func() {
+		for {
+			line, ok := job.next()
+			if !ok {
+				break
+			}
+			pw.Write([]byte(line))
+		}
+		pw.Close()
+	}()
+
+	w := &jobWriter{m: m}
+	if id != "" {
+		w.prefix = "J " + id + " "
+		// Jobs are already past the handshake.
+		w.skipVersion = true
+		if m.extensions != "" {
+			job.send(m.extensions)
+			w.skipExtensions = true
+		}
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		job.err = external.RunLoop(pr, w, m.h)
+		// Discard anything else git-annex sends to this job.
+		pr.CloseWithError(io.ErrClosedPipe)
+		if job.err != nil && id != "" {
+			fmt.Fprintf(os.Stderr, "git-annex-remote-b2: job %v: %v\n", id, job.err)
+		}
+	}()
+
+	return job
+}
+
+func (job *asyncJob) send(line string) {
+	job.mu.Lock()
+	job.lines = append(job.lines, line)
+	job.mu.Unlock()
+	job.ready.Signal()
+}
+
+// next waits for the next line sent to the job, and returns false once the
+// job is closed and there are none left.
+func (job *asyncJob) next() (string, bool) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	for len(job.lines) == 0 && !job.closed {
+		job.ready.Wait()
+	}
+	if len(job.lines) == 0 {
+		return "", false
+	}
+	line := job.lines[0]
+	job.lines[0] = ""
+	job.lines = job.lines[1:]
+	return line, true
+}
+
+func (job *asyncJob) close() {
+	job.mu.Lock()
+	job.closed = true
+	job.mu.Unlock()
+	job.ready.Signal()
+}
+
+// jobWriter prefixes each line written by a job, and keeps the output of
+// different jobs from being interleaved.
+type jobWriter struct {
+	m              *asyncMux
+	prefix         string
+	skipVersion    bool
+	skipExtensions bool
+	buf            bytes.Buffer
+}
+
+func (w *jobWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := w.buf.Next(i + 1)
+
+		if w.skipVersion && bytes.HasPrefix(line, []byte("VERSION ")) {
+			w.skipVersion = false
+			continue
+		}
+		if w.skipExtensions && bytes.HasPrefix(line, []byte("EXTENSIONS ")) {
+			w.skipExtensions = false
+			continue
+		}
+
+		w.m.outMu.Lock()
+		_, err := fmt.Fprintf(w.m.out, "%s%s", w.prefix, line)
+		w.m.outMu.Unlock()
+		if err != nil {
+			return len(p), err
+		}
+	}
+}
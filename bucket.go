@@ -0,0 +1,235 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kothar/go-backblaze"
+)
+
+// lifecycleRule is backblaze.LifecycleRule, which sends an unset number of
+// days as 0 rather than null and so can't leave either of them out.
+type lifecycleRule struct {
+	DaysFromHidingToDeleting  *int   `json:"daysFromHidingToDeleting"`
+	DaysFromUploadingToHiding *int   `json:"daysFromUploadingToHiding"`
+	FileNamePrefix            string `json:"fileNamePrefix"`
+}
+
+func lifecycleRules(rules []backblaze.LifecycleRule) []lifecycleRule {
+	days := func(n int) *int {
+		if n == 0 {
+			return nil
+		}
+		return &n
+	}
+
+	res := make([]lifecycleRule, 0, len(rules))
+	for _, rule := range rules {
+		res = append(res, lifecycleRule{
+			DaysFromHidingToDeleting:  days(rule.DaysFromHidingToDeleting),
+			DaysFromUploadingToHiding: days(rule.DaysFromUploadingToHiding),
+			FileNamePrefix:            rule.FileNamePrefix,
+		})
+	}
+	return res
+}
+
+// parseLifecycle returns the lifecycle rule that keeps versions under prefix
+// for the given number of days after they have been hidden or superseded, or
+// nil if days is unset.
+func parseLifecycle(days, prefix string) (*lifecycleRule, error) {
+	if days == "" {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(days)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("couldn't parse days to keep prior versions %#v, expected a positive number", days)
+	}
+	return &lifecycleRule{
+		DaysFromHidingToDeleting: &n,
+		FileNamePrefix:           prefix,
+	}, nil
+}
+
+// bucketSettings are what openBucket creates a missing bucket with.
+type bucketSettings struct {
+	bucketType backblaze.BucketType
+	encryption string
+	info       map[string]string
+	lifecycle  *lifecycleRule
+}
+
+// parseBucketSettings checks the bucket-type, bucket-encryption and
+// bucket-info settings.
+func parseBucketSettings(bucketType, encryption, info string) (*bucketSettings, error) {
+	settings := &bucketSettings{}
+
+	switch bucketType {
+	case "", "private":
+		settings.bucketType = backblaze.AllPrivate
+	case "public":
+		settings.bucketType = backblaze.AllPublic
+	default:
+		return nil, fmt.Errorf("unknown bucket type %#v, expected private or public", bucketType)
+	}
+
+	switch encryption {
+	case "", "none":
+	case sseB2:
+		settings.encryption = encryption
+	default:
+		return nil, fmt.Errorf("unknown bucket encryption %#v, expected none or b2", encryption)
+	}
+
+	if info != "" {
+		settings.info = make(map[string]string)
+		for _, pair := range strings.Split(info, ",") {
+			i := strings.Index(pair, "=")
+			if i < 1 {
+				return nil, fmt.Errorf("couldn't parse bucket info %#v, expected key=value pairs separated by commas", info)
+			}
+			settings.info[pair[:i]] = pair[i+1:]
+		}
+	}
+
+	return settings, nil
+}
+
+func (settings *bucketSettings) describe() string {
+	desc := "private"
+	if settings.bucketType == backblaze.AllPublic {
+		desc = "public"
+	}
+	if settings.encryption == sseB2 {
+		desc += " encrypted"
+	}
+	return desc
+}
+
+type serverSideEncryption struct {
+	Mode           string `json:"mode"`
+	Algorithm      string `json:"algorithm"`
+	CustomerKey    string `json:"customerKey,omitempty"`
+	CustomerKeyMd5 string `json:"customerKeyMd5,omitempty"`
+}
+
+type createBucketRequest struct {
+	AccountID                   string                `json:"accountId"`
+	BucketName                  string                `json:"bucketName"`
+	BucketType                  string                `json:"bucketType"`
+	BucketInfo                  map[string]string     `json:"bucketInfo,omitempty"`
+	DefaultServerSideEncryption *serverSideEncryption `json:"defaultServerSideEncryption,omitempty"`
+	LifecycleRules              []lifecycleRule       `json:"lifecycleRules,omitempty"`
+}
+
+// createBucket is B2.CreateBucket with the remote's settings for new buckets.
+// The bucket has to be listed afterwards to open it.
+func (be *B2Ext) createBucket(name string, settings *bucketSettings) error {
+	api, err := be.api()
+	if err != nil {
+		return err
+	}
+
+	request := &createBucketRequest{
+		AccountID:  api.accountID,
+		BucketName: name,
+		BucketType: string(settings.bucketType),
+		BucketInfo: settings.info,
+	}
+	if settings.encryption == sseB2 {
+		request.DefaultServerSideEncryption = &serverSideEncryption{
+			Mode:      "SSE-B2",
+			Algorithm: "AES256",
+		}
+	}
+	if settings.lifecycle != nil {
+		request.LifecycleRules = []lifecycleRule{*settings.lifecycle}
+	}
+
+	return be.call("b2_create_bucket", request, &struct{}{})
+}
+
+type updateBucketRequest struct {
+	AccountID      string          `json:"accountId"`
+	BucketID       string          `json:"bucketId"`
+	LifecycleRules []lifecycleRule `json:"lifecycleRules"`
+	IfRevisionIs   int             `json:"ifRevisionIs,omitempty"`
+}
+
+// updateLifecycle replaces the bucket's lifecycle rule for prefix with rule,
+// or removes it if rule is nil, leaving the rules for other prefixes alone.
+func (be *B2Ext) updateLifecycle(prefix string, rule *lifecycleRule) error {
+	api, err := be.api()
+	if err != nil {
+		return err
+	}
+
+	var rules []lifecycleRule
+	for _, r := range lifecycleRules(be.bucket().LifecycleRules) {
+		if r.FileNamePrefix != prefix {
+			rules = append(rules, r)
+		}
+	}
+	if rule != nil {
+		rules = append(rules, *rule)
+	}
+	if rules == nil {
+		rules = []lifecycleRule{}
+	}
+
+	// Fail rather than undo whatever else changed the rules since the
+	// bucket was listed.
+	return be.call("b2_update_bucket", &updateBucketRequest{
+		AccountID:      api.accountID,
+		BucketID:       be.bucket().ID,
+		LifecycleRules: rules,
+		IfRevisionIs:   be.bucket().Revision,
+	}, &struct{}{})
+}
+
+func runLifecycle(args []string) error {
+	flags := flag.NewFlagSet("lifecycle", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: git-annex-remote-b2 lifecycle [options]\n\n")
+		fmt.Fprintf(flags.Output(), "Sets the bucket's lifecycle rule for the remote's prefix, replacing any\n")
+		fmt.Fprintf(flags.Output(), "rule for the same prefix. Credentials are read from the B2_ACCOUNT_ID,\n")
+		fmt.Fprintf(flags.Output(), "B2_KEY_ID and B2_APP_KEY environment variables.\n\n")
+		flags.PrintDefaults()
+	}
+	bucket := flags.String("bucket", "", "B2 bucket name (or B2_BUCKET environment variable)")
+	prefix := flags.String("prefix", "", "object key prefix of the remote")
+	keepDays := flags.Int("keep-prior-versions-days", 0, "days to keep hidden and superseded versions for, or 0 to remove the rule")
+	flags.Parse(args)
+
+	be := &B2Ext{}
+	err := be.setup(cliConfig{
+		"bucket": *bucket,
+		"prefix": *prefix,
+	}, false)
+	if err != nil {
+		return err
+	}
+
+	var rule *lifecycleRule
+	if *keepDays > 0 {
+		rule, err = parseLifecycle(strconv.Itoa(*keepDays), be.prefix)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = be.updateLifecycle(be.prefix, rule)
+	if err != nil {
+		return fmt.Errorf("couldn't update lifecycle rules: %v", err)
+	}
+	if rule != nil {
+		fmt.Fprintf(os.Stdout, "versions under %#v are deleted %v days after being hidden\n", be.prefix, *keepDays)
+	} else {
+		fmt.Fprintf(os.Stdout, "removed the lifecycle rule for %#v\n", be.prefix)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"unsafe"
+
+	"github.com/kothar/go-backblaze"
+)
+
+// The bucket-cache setting remembers the ID and type of each of the remote's
+// buckets from when it was last initialized or enabled, as a list of
+// name:id:type. Preparing the remote opens its buckets from there rather
+// than listing them, which would be another class C transaction every time
+// git-annex starts it, and which keys without the listBuckets capability
+// can't do at all. If B2 later says that a bucket is gone, it is looked up
+// by name again.
+
+// cachedBucket returns what cache says about the bucket called bucketName or
+// with the ID bucketID, or nil if it isn't there.
+func cachedBucket(cache, accountID, bucketName, bucketID string) (*backblaze.BucketInfo, error) {
+	if cache == "" {
+		return nil, nil
+	}
+
+	for _, entry := range strings.Split(cache, ",") {
+		fields := strings.Split(entry, ":")
+		if len(fields) != 3 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("couldn't parse bucket-cache %#v", cache)
+		}
+		if (bucketName == "" || fields[0] == bucketName) && (bucketID == "" || fields[1] == bucketID) {
+			return &backblaze.BucketInfo{
+				AccountID:  accountID,
+				Name:       fields[0],
+				ID:         fields[1],
+				BucketType: backblaze.BucketType(fields[2]),
+				Info:       map[string]string{},
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+// newBucket makes the bucket described by info without asking B2 about it.
+// go-backblaze only makes buckets out of what B2 answers, and keeps the client
+// they are used with and their pool of upload URLs unexported, so those are
+// set here the way it would set them.
+func newBucket(b2 *backblaze.B2, info *backblaze.BucketInfo) *backblaze.Bucket {
+	bucket := &backblaze.Bucket{BucketInfo: info}
+	v := reflect.ValueOf(bucket).Elem()
+	setUnexported(v.FieldByName("b2"), b2)
+	setUnexported(v.FieldByName("uploadAuthPool"), make(chan *backblaze.UploadAuth, b2.MaxIdleUploads))
+	return bucket
+}
+
+func setUnexported(field reflect.Value, value interface{}) {
+	reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem().Set(reflect.ValueOf(value))
+}
+
+// saveBucketCache saves the buckets that were opened, during initremote or
+// enableremote.
+func (be *B2Ext) saveBucketCache(e configSource) error {
+	shards := be.shards
+	if len(shards) == 0 {
+		shards = []*B2Ext{be}
+	}
+
+	var entries []string
+	for _, shard := range shards {
+		bucket := shard.bucket()
+		entries = append(entries, bucket.Name+":"+bucket.ID+":"+string(bucket.BucketType))
+	}
+	return e.SetConfig("bucket-cache", strings.Join(entries, ","))
+}
+
+// openedBucket is the bucket that the remote is stored in, as made for the
+// client of the application key that was in use.
+type openedBucket struct {
+	info   *backblaze.BucketInfo
+	client *backblaze.B2
+	bucket *backblaze.Bucket
+}
+
+// bucket returns the bucket that the remote is stored in. A bucket is tied to
+// the client it was made with, so once the remote has failed over to another
+// application key it is made again with that key's client.
+func (be *B2Ext) bucket() *backblaze.Bucket {
+	opened, _ := be.openedBucket.Load().(*openedBucket)
+	if opened == nil {
+		return nil
+	}
+
+	client := be.client()
+	if opened.client != client {
+		opened = &openedBucket{
+			info:   opened.info,
+			client: client,
+			bucket: newBucket(client, opened.info),
+		}
+		be.openedBucket.Store(opened)
+	}
+	return opened.bucket
+}
+
+// setBucket makes info the bucket that the remote is stored in.
+func (be *B2Ext) setBucket(info *backblaze.BucketInfo) {
+	be.openedBucket.Store(&openedBucket{info: info})
+}
+
+// isBucketGone reports whether B2 refused a call because the bucket it was
+// made for doesn't exist.
+func isBucketGone(err error) bool {
+	b2err, ok := err.(*backblaze.B2Error)
+	return ok && b2err.Status == http.StatusBadRequest && b2err.Code == "bad_bucket_id"
+}
+
+// retryReopened tries attempt again if err says that the bucket it was made
+// for is gone and it turns up with a new ID, and otherwise returns err.
+func (be *B2Ext) retryReopened(gone *backblaze.Bucket, err error, attempt func() error) error {
+	if !isBucketGone(err) {
+		return err
+	}
+	ok, rerr := be.reopenBucket(gone)
+	if rerr != nil {
+		return rerr
+	}
+	if !ok {
+		return err
+	}
+	stats.retried()
+	return attempt()
+}
+
+// withBucket calls attempt, trying it again once if the bucket has to be
+// looked up again, or once authorized again if B2 no longer knows the token;
+// go-backblaze only does that itself when the token has expired.
+func (be *B2Ext) withBucket(attempt func() error) error {
+	gone := be.bucket()
+	err := attempt()
+	if isExpiredAuth(err) {
+		err = be.reauthorize()
+		if err == nil {
+			stats.retried()
+			err = attempt()
+		}
+	}
+	return be.retryReopened(gone, err, attempt)
+}
+
+// reopenBucket looks up the bucket by name again once B2 has said that the
+// ID it was opened with from the cache is gone, as happens when a bucket is
+// deleted and created again. It reports whether the bucket turned up with a
+// new ID, in which case whatever failed can be tried again.
+func (be *B2Ext) reopenBucket(gone *backblaze.Bucket) (bool, error) {
+	be.setupMu.Lock()
+	defer be.setupMu.Unlock()
+
+	if be.bucket().ID != gone.ID {
+		// Another job got there first.
+		return true, nil
+	}
+	if !be.bucketCached {
+		return false, nil
+	}
+
+	bucket, err := be.findBucket(gone.Name, "", nil)
+	if err != nil {
+		return false, err
+	}
+	if bucket == nil {
+		return false, fmt.Errorf("bucket %#v does not exist anymore", gone.Name)
+	}
+	be.bucketCached = false
+	if bucket.ID == gone.ID {
+		return false, nil
+	}
+
+	logs.logf(levelInfo, "bucket %v was found with the new ID %v, run git annex enableremote to remember it", bucket.Name, bucket.ID)
+	notices.add(fmt.Sprintf("bucket %v has a new ID, run git annex enableremote to remember it", bucket.Name))
+	be.mu.Lock()
+	be.clearListFileCache()
+	be.cache.reset()
+	be.mu.Unlock()
+	be.setBucket(bucket)
+	return true, nil
+}
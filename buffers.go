@@ -0,0 +1,21 @@
+package main
+
+import (
+	"io"
+)
+
+// The buffer-size setting sets the size of the buffers that file contents
+// are copied through on their way to and from B2, both here and in the HTTP
+// transport. The defaults are a few tens of KiB per transfer, which only
+// matters with many transfers at once on a small machine, or for throughput
+// on a fast one.
+
+// copyContents is io.Copy through a buffer of the buffer-size setting, or
+// io.Copy's own if it is unset.
+func (be *B2Ext) copyContents(dst io.Writer, src io.Reader) (int64, error) {
+	if be.bufferSize == 0 {
+		return io.Copy(dst, src)
+	}
+	// Hide ReadFrom and WriteTo, which would bring buffers of their own.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, make([]byte, be.bufferSize))
+}
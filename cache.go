@@ -0,0 +1,264 @@
+package main
+
+import (
+	"container/list"
+	"sort"
+	"time"
+
+	"github.com/kothar/go-backblaze"
+)
+
+// Number of filenames fetched by each listing made to fill the cache. B2
+// bills ListFileNames per 1000 names returned, so asking for more in one
+// call doesn't make it any cheaper.
+const cachePageSize = 1000
+
+// fileCache remembers the file IDs of names under the prefix. Rather than
+// listing the whole bucket up front, pages of the listing are fetched as
+// lookups fall outside of what has already been seen, and the ranges of
+// names those pages covered are kept so that absent files can be answered
+// from the cache too.
+//
+// Once maxFiles names are cached, no more pages are listed, and each name
+// added after that pushes out the one that was cached first. If lru is set,
+// the pages that were least recently looked in are dropped to make room
+// instead. Those are kept in pages rather than merged into covered.
+type fileCache struct {
+	filemap     map[string]string
+	covered     []nameRange
+	pages       *list.List
+	order       *list.List
+	orderOf     map[string]*list.Element
+	enabled     bool
+	lru         bool
+	duration    time.Duration
+	maxFiles    int
+	timeWritten time.Time
+}
+
+// cachePage is a page of the listing kept by an LRU cache, with the names it
+// added to the cache.
+type cachePage struct {
+	nameRange
+	names []string
+}
+
+// nameRange covers the names from start up to but not including end, where
+// an empty end extends to the end of the listing.
+type nameRange struct {
+	start string
+	end   string
+}
+
+func (r nameRange) contains(name string) bool {
+	return name >= r.start && (r.end == "" || name < r.end)
+}
+
+// settings returns an empty cache with the same settings as c.
+func (c *fileCache) settings() fileCache {
+	return fileCache{
+		enabled:  c.enabled,
+		lru:      c.lru,
+		duration: c.duration,
+		maxFiles: c.maxFiles,
+	}
+}
+
+func (c *fileCache) reset() {
+	c.filemap = make(map[string]string)
+	c.covered = nil
+	c.pages = list.New()
+	c.order = list.New()
+	c.orderOf = make(map[string]*list.Element)
+	c.timeWritten = time.Now()
+}
+
+// page returns the page of an LRU cache that covers name, or nil.
+func (c *fileCache) page(name string) *list.Element {
+	for el := c.pages.Front(); el != nil; el = el.Next() {
+		if el.Value.(*cachePage).contains(name) {
+			return el
+		}
+	}
+	return nil
+}
+
+// lookup reports whether name is known to the cache, and if so whether or
+// not it exists.
+func (c *fileCache) lookup(name string) (known, found bool, fileID string) {
+	if c.filemap == nil || c.duration != 0 && time.Since(c.timeWritten) > c.duration {
+		c.reset()
+	}
+
+	if c.lru {
+		el := c.page(name)
+		if el == nil {
+			return false, false, ""
+		}
+		c.pages.MoveToFront(el)
+		id, ok := c.filemap[name]
+		return true, ok, id
+	}
+
+	if id, ok := c.filemap[name]; ok {
+		return true, true, id
+	}
+
+	for _, r := range c.covered {
+		if r.contains(name) {
+			return true, false, ""
+		}
+	}
+
+	return false, false, ""
+}
+
+// addPage records a page of the listing that began at start.
+func (c *fileCache) addPage(start string, response *backblaze.ListFilesResponse) {
+	if c.lru {
+		page := &cachePage{nameRange: nameRange{start, response.NextFileName}}
+		for _, file := range response.Files {
+			if file.Action == backblaze.Upload {
+				c.filemap[file.Name] = file.ID
+				page.names = append(page.names, file.Name)
+			}
+		}
+		c.pages.PushFront(page)
+		c.evict()
+		return
+	}
+
+	for _, file := range response.Files {
+		if file.Action == backblaze.Upload {
+			c.insert(file.Name, file.ID)
+		}
+	}
+
+	c.covered = append(c.covered, nameRange{start, response.NextFileName})
+	sort.Slice(c.covered, func(i, j int) bool {
+		return c.covered[i].start < c.covered[j].start
+	})
+
+	merged := c.covered[:1]
+	for _, r := range c.covered[1:] {
+		last := &merged[len(merged)-1]
+		switch {
+		case last.end == "":
+		case r.start <= last.end:
+			if r.end == "" || r.end > last.end {
+				last.end = r.end
+			}
+		default:
+			merged = append(merged, r)
+		}
+	}
+	c.covered = merged
+}
+
+// evict drops the least recently used pages of an LRU cache until it is back
+// down to maxFiles names, always keeping the newest page. Names are only
+// dropped if no other page covers them.
+func (c *fileCache) evict() {
+	for c.maxFiles > 0 && len(c.filemap) > c.maxFiles && c.pages.Len() > 1 {
+		page := c.pages.Remove(c.pages.Back()).(*cachePage)
+		for _, name := range page.names {
+			if c.page(name) == nil {
+				delete(c.filemap, name)
+			}
+		}
+	}
+}
+
+// insert adds name to a cache without lru, remembering the order that names
+// were added in.
+func (c *fileCache) insert(name, fileID string) {
+	if _, ok := c.orderOf[name]; !ok {
+		c.orderOf[name] = c.order.PushBack(name)
+	}
+	c.filemap[name] = fileID
+}
+
+// evictOldest drops the name that was added to a cache without lru first.
+// The range that covered it is cut short there, since its absence from the
+// cache no longer means that it doesn't exist, and neither does that of any
+// name after it that the range covered.
+func (c *fileCache) evictOldest() {
+	el := c.order.Front()
+	if el == nil {
+		return
+	}
+	name := c.order.Remove(el).(string)
+	delete(c.orderOf, name)
+	delete(c.filemap, name)
+
+	for i, r := range c.covered {
+		if !r.contains(name) {
+			continue
+		}
+		if name > r.start {
+			c.covered[i].end = name
+		} else {
+			c.covered = append(c.covered[:i], c.covered[i+1:]...)
+		}
+		break
+	}
+}
+
+// full reports whether the cache has reached maxFiles and shouldn't list any
+// more pages.
+func (c *fileCache) full() bool {
+	return !c.lru && c.maxFiles > 0 && len(c.filemap) >= c.maxFiles
+}
+
+func (c *fileCache) add(name, fileID string) {
+	if c.filemap == nil {
+		return
+	}
+	if c.lru {
+		// Names outside of the pages would never be dropped.
+		el := c.page(name)
+		if el == nil {
+			return
+		}
+		if _, ok := c.filemap[name]; !ok {
+			page := el.Value.(*cachePage)
+			page.names = append(page.names, name)
+		}
+		c.filemap[name] = fileID
+		return
+	}
+
+	if _, ok := c.filemap[name]; !ok && c.full() {
+		c.evictOldest()
+	}
+	c.insert(name, fileID)
+}
+
+func (c *fileCache) remove(name string) {
+	delete(c.filemap, name)
+	if el, ok := c.orderOf[name]; ok {
+		c.order.Remove(el)
+		delete(c.orderOf, name)
+	}
+}
+
+// fillCache adds the page of filenames starting at name to the cache, and
+// reports whether name was among them.
+func (be *B2Ext) fillCache(name string) (found bool, fileID string, err error) {
+	var response *backblaze.ListFilesResponse
+	err = be.withBucket(func() (err error) {
+		response, err = be.bucket().ListFileNamesWithPrefix(name, cachePageSize, be.prefix, be.keyDelimiter())
+		return err
+	})
+	if err != nil {
+		return false, "", err
+	}
+
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	be.cache.addPage(name, response)
+
+	_, found, fileID = be.cache.lookup(name)
+	return found, fileID, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/arcnmx/go-git-annex-external/external"
+	"github.com/klauspost/compress/zstd"
+	"github.com/kothar/go-backblaze"
+)
+
+// With compression set, keys are compressed before they are uploaded. The
+// SHA1 that B2 keeps is then that of the compressed content, so the codec is
+// recorded in the file info along with the SHA1 of the key's own content,
+// which is what an upload is compared against before it is skipped. Whatever
+// is downloaded is decompressed according to its file info, whatever the
+// setting is now.
+const (
+	compressionInfo      = "compression"
+	uncompressedSHA1Info = "uncompressed_sha1"
+)
+
+// parseCompression checks the compression setting, returning "" for none.
+func parseCompression(s string) (string, error) {
+	switch s {
+	case "", "none":
+		return "", nil
+	case "gzip", "zstd":
+		return s, nil
+	default:
+		return "", fmt.Errorf("unknown compression %#v, expected none, gzip or zstd", s)
+	}
+}
+
+func compressor(codec string, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unknown compression %#v", codec)
+	}
+}
+
+func decompressor(codec string, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %#v", codec)
+	}
+}
+
+// compressedInfo returns the file info that records how content with the
+// SHA1 sha was compressed.
+func compressedInfo(codec string, sha []byte) map[string]string {
+	return map[string]string{
+		compressionInfo:      codec,
+		uncompressedSHA1Info: hex.EncodeToString(sha),
+	}
+}
+
+// fileInfoValue returns the file info called name of b2file. go-backblaze
+// takes the names of downloads from headers that net/http has recapitalised,
+// so they are matched regardless of case.
+func fileInfoValue(b2file *backblaze.File, name string) string {
+	if v, ok := b2file.FileInfo[name]; ok {
+		return v
+	}
+	for k, v := range b2file.FileInfo {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// storedSHA1 returns the hex SHA1 of the content that b2file holds once it
+// has been decompressed, or "" if that isn't known.
+func storedSHA1(b2file *backblaze.File) string {
+	if fileInfoValue(b2file, compressionInfo) != "" {
+		return fileInfoValue(b2file, uncompressedSHA1Info)
+	}
+	return contentSHA1(b2file)
+}
+
+// compressFile compresses fh with codec into a temporary file in the
+// repository, and returns it rewound along with the SHA1 of fh. The caller
+// has to close and remove it.
+func (be *B2Ext) compressFile(e *external.External, fh *os.File, codec string) (*os.File, []byte, error) {
+	dir, err := be.workDir(e, "tmp")
+	if err != nil {
+		return nil, nil, err
+	}
+	tmp, err := ioutil.TempFile(dir, "compress")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sha, err := be.compressTo(tmp, fh, codec)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, nil, err
+	}
+	return tmp, sha, nil
+}
+
+func (be *B2Ext) compressTo(w io.Writer, fh *os.File, codec string) ([]byte, error) {
+	_, err := fh.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	cw, err := compressor(codec, w)
+	if err != nil {
+		return nil, err
+	}
+	hasher := sha1.New()
+	_, err = be.copyContents(cw, io.TeeReader(fh, hasher))
+	if err != nil {
+		cw.Close()
+		return nil, err
+	}
+	err = cw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
+
+// decompressFile replaces file, the downloaded contents of b2file, with
+// their decompressed contents if b2file was stored compressed.
+func (be *B2Ext) decompressFile(fh *os.File, file string, b2file *backblaze.File) error {
+	codec := fileInfoValue(b2file, compressionInfo)
+	if codec == "" {
+		return nil
+	}
+
+	_, err := fh.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	r, err := decompressor(codec, fh)
+	if err != nil {
+		return fmt.Errorf("couldn't decompress %v: %v", b2file.Name, err)
+	}
+	defer r.Close()
+
+	// Written next to file so that it can be renamed over it.
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".decompress")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hasher := sha1.New()
+	_, err = be.copyContents(io.MultiWriter(tmp, hasher), r)
+	if err != nil {
+		return fmt.Errorf("couldn't decompress %v: %v", b2file.Name, err)
+	}
+	if want := fileInfoValue(b2file, uncompressedSHA1Info); want != "" {
+		if have := hex.EncodeToString(hasher.Sum(nil)); have != want {
+			return fmt.Errorf("decompressed file has SHA1 %v, expected %v", have, want)
+		}
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
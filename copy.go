@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/arcnmx/go-git-annex-external/external"
+	"github.com/kothar/go-backblaze"
+)
+
+type copyFileRequest struct {
+	SourceFileID                    string                `json:"sourceFileId"`
+	FileName                        string                `json:"fileName"`
+	MetadataDirective               string                `json:"metadataDirective"`
+	ContentType                     string                `json:"contentType"`
+	FileInfo                        map[string]string     `json:"fileInfo"`
+	SourceServerSideEncryption      *serverSideEncryption `json:"sourceServerSideEncryption,omitempty"`
+	DestinationServerSideEncryption *serverSideEncryption `json:"destinationServerSideEncryption,omitempty"`
+	FileRetention                   *fileRetention        `json:"fileRetention,omitempty"`
+	LegalHold                       string                `json:"legalHold,omitempty"`
+}
+
+// copyFile makes a new version of name with the contents of another file
+// version, without downloading or uploading it. The copy gets the content
+// type and file info that an upload of key to name would.
+func (be *B2Ext) copyFile(e *external.External, sourceFileID, name, key string, export bool) (*backblaze.File, error) {
+	info := be.fileInfo(e, name, key, export, nil)
+	if info == nil {
+		info = map[string]string{}
+	}
+
+	request := &copyFileRequest{
+		SourceFileID:                    sourceFileID,
+		FileName:                        name,
+		MetadataDirective:               "REPLACE",
+		ContentType:                     be.contentType(name, export),
+		FileInfo:                        info,
+		DestinationServerSideEncryption: be.sse.params(),
+	}
+	if be.sse.mode == sseC {
+		// Everything in the remote was stored with the same key.
+		request.SourceServerSideEncryption = be.sse.params()
+	}
+	request.FileRetention, request.LegalHold = be.lock.params(time.Now())
+
+	b2file := &backblaze.File{}
+	err := be.retry(e, "copy", func() error {
+		return be.call("b2_copy_file", request, b2file)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	be.fileStored(b2file.Name, b2file.ID)
+	return b2file, nil
+}
+
+// copySource returns a file version other than name that holds the contents
+// of key, to copy rather than upload them again: the one this process stored
+// key as, or where the bucket has key stored, which an exported file can be
+// copied from. Versions from the bucket only count if their SHA1 matches that
+// of fh, which is hashed if sha isn't already its SHA1 and returned along with
+// the version, and compressed ones never do, since a copy of one is given new
+// file info.
+func (be *B2Ext) copySource(e *external.External, key, name string, fh *os.File, sha []byte) (string, []byte, error) {
+	be.mu.Lock()
+	fileID, ok := be.stored[key]
+	be.mu.Unlock()
+	if ok {
+		return fileID, sha, nil
+	}
+
+	var candidates []string
+	_, pinned, err := be.pinnedVersion(e, key)
+	if err != nil {
+		e.Debug(fmt.Sprintf("couldn't look up the version of %v that was stored: %v", key, err))
+	}
+	if pinned != nil && pinned.Name != name {
+		candidates = append(candidates, pinned.ID)
+	} else if stored := be.keyName(key); stored != name {
+		found, fileID, err := be.listFileCached(stored)
+		if err != nil {
+			e.Debug(fmt.Sprintf("couldn't list filenames: %v", err))
+		}
+		if found {
+			candidates = append(candidates, fileID)
+		}
+	}
+
+	for _, fileID := range candidates {
+		b2file, err := be.bucket().GetFileInfo(fileID)
+		if err != nil {
+			e.Debug(fmt.Sprintf("couldn't get file info for %#v: %v", fileID, err))
+			continue
+		}
+		if fileInfoValue(b2file, compressionInfo) != "" {
+			continue
+		}
+		if sha == nil {
+			_, err = fh.Seek(0, io.SeekStart)
+			if err == nil {
+				sha, err = hashFile(fh)
+			}
+			if err != nil {
+				return "", nil, err
+			}
+		}
+		if contentSHA1(b2file) == hex.EncodeToString(sha) {
+			be.keyStored(key, fileID)
+			return fileID, sha, nil
+		}
+	}
+	return "", sha, nil
+}
+
+// keyStored records that fileID holds the verified contents of key.
+func (be *B2Ext) keyStored(key, fileID string) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	if be.stored == nil {
+		be.stored = make(map[string]string)
+	}
+	be.stored[key] = fileID
+}
+
+// renameExport moves an exported file from one name to another with a copy,
+// then removes it from where it was.
+func (be *B2Ext) renameExport(e *external.External, key, from, to string) error {
+	if be.appendOnly {
+		return errors.New("refusing to rename in an appendonly remote")
+	}
+	err := be.checkRetained(from)
+	if err != nil {
+		return err
+	}
+
+	found, fileID, err := be.listFileCached(from)
+	if err != nil {
+		return fmt.Errorf("couldn't list filenames: %v", err)
+	}
+	if !found {
+		return fmt.Errorf("%v is not in the bucket", from)
+	}
+
+	var b2file *backblaze.File
+	if be.s3 != nil {
+		err = be.retry(e, "copy", func() (err error) {
+			b2file, err = be.s3.copyObject(from, fileID, to, be.contentType(to, true), be.fileInfo(e, to, key, true, nil))
+			return err
+		})
+		if err == nil {
+			be.fileStored(to, b2file.ID)
+		}
+	} else {
+		b2file, err = be.copyFile(e, fileID, to, key, true)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't copy %v: %v", from, err)
+	}
+	be.keyStored(key, b2file.ID)
+
+	return be.removeFile(from)
+}
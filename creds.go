@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Credentials are handed to git-annex with SETCREDS, which keeps them out of
+// the git-annex branch unless embedcreds=yes is passed to initremote or gpg
+// encryption is used, and encrypts them whenever encryption is on. They are
+// only ever saved during initremote or enableremote.
+//
+// The application key is saved as the b2_appkey creds, with its key ID as the
+// login; for the master application key, that is the account ID. Spare keys
+// are saved as b2_appkey_2 and so on, and the SSE-C key as b2_ssekey. The
+// bucket is an ordinary setting. An application key from the creds-command is
+// fetched afresh every time and never saved.
+//
+// Remotes set up by older versions saved the account ID as the login of the
+// b2_account creds, with the bucket name as its password, and left the key ID
+// of b2_appkey empty for the master application key. They are still read,
+// and are saved in the current layout the next time the remote is enabled.
+
+// getCreds reads the application keys and bucket into config, from the
+// environment, the creds-command, the remote's settings or its creds.
+func getCreds(e configSource, config *configValues) (err error) {
+	// Only used by the old layout.
+	var accountCreds struct {
+		read              bool
+		accountID, bucket string
+	}
+	readAccountCreds := func() error {
+		if accountCreds.read {
+			return nil
+		}
+		accountCreds.read = true
+		var err error
+		accountCreds.accountID, accountCreds.bucket, err = e.GetCreds("b2_account")
+		return err
+	}
+
+	config.accountID = os.Getenv("B2_ACCOUNT_ID")
+	if config.accountID == "" {
+		config.accountID, err = e.GetConfig("accountid")
+		if err != nil {
+			return err
+		}
+	}
+
+	config.credsCommand = os.Getenv("B2_CREDS_COMMAND")
+	if config.credsCommand == "" {
+		config.credsCommand, err = e.GetConfig("creds-command")
+		if err != nil {
+			return err
+		}
+	}
+
+	config.keyID, config.appKey = os.Getenv("B2_KEY_ID"), os.Getenv("B2_APP_KEY")
+	if config.appKey != "" {
+		config.saveCreds = true
+	} else if config.credsCommand != "" {
+		// Whatever the command prints is never saved anywhere.
+		var keyID string
+		keyID, config.appKey, err = runCredsCommand(config.credsCommand)
+		if err != nil {
+			return err
+		}
+		if keyID != "" {
+			config.keyID = keyID
+		}
+		if config.keyID == "" {
+			config.keyID, err = e.GetConfig("appkeyid")
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		// Setting the key itself on the command line of initremote works,
+		// but it is moved into the creds rather than left in the clear
+		// in the git-annex branch.
+		config.appKey, err = e.GetConfig("appkey")
+		if config.appKey != "" && err == nil {
+			config.keyID, err = e.GetConfig("appkeyid")
+			config.saveCreds = true
+			config.clearKeyConfig = true
+		}
+		if config.appKey == "" && err == nil {
+			config.keyID, config.appKey, err = e.GetCreds("b2_appkey")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if config.appKey == "" {
+		return errors.New("You must set B2_APP_KEY to the backblaze application key")
+	}
+
+	if config.keyID == "" {
+		// The master application key is identified by the account ID.
+		if config.accountID == "" {
+			err = readAccountCreds()
+			if err != nil {
+				return err
+			}
+			config.accountID = accountCreds.accountID
+			if config.accountID != "" && config.credsCommand == "" {
+				config.saveCreds = true
+			}
+		}
+		config.keyID = config.accountID
+	}
+	if config.keyID == "" {
+		return errors.New("You must set B2_KEY_ID to the backblaze application key ID, or B2_ACCOUNT_ID to the account id for the master application key")
+	}
+
+	// Spare keys to fail over to are numbered from 2, the first key being
+	// the one above.
+	for n := 2; ; n++ {
+		var key appKey
+		key, err = getSpareKey(e, n)
+		if err != nil {
+			return err
+		}
+		if key.appKey == "" {
+			break
+		}
+		config.spareKeys = append(config.spareKeys, key)
+	}
+
+	config.bucketName = os.Getenv("B2_BUCKET")
+	if config.bucketName != "" {
+		config.saveBucket = true
+	} else {
+		config.bucketName, err = e.GetConfig("bucket")
+		if config.bucketName == "" && err == nil {
+			err = readAccountCreds()
+			config.bucketName = accountCreds.bucket
+			if config.bucketName != "" {
+				config.saveBucket = true
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	config.buckets = os.Getenv("B2_BUCKETS")
+	if config.buckets != "" {
+		config.saveBucket = true
+	} else {
+		config.buckets, err = e.GetConfig("buckets")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Names that the key ID can be given under in the output of a creds-command,
+// following the conventions of pass.
+var credsCommandKeyIDs = map[string]bool{
+	"keyid":    true,
+	"login":    true,
+	"user":     true,
+	"username": true,
+}
+
+// runCredsCommand runs command with the shell and reads an application key
+// from its output. The key is on the first line, the way pass prints a
+// password, and its key ID can follow on a later line as "keyid: ...".
+func runCredsCommand(command string) (keyID, appKey string, err error) {
+	cmd := exec.Command("sh", "-c", command)
+	// Our stdin is the protocol with git-annex.
+	cmd.Stdin = nil
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return "", "", fmt.Errorf("creds-command failed: %v: %v", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", "", fmt.Errorf("creds-command failed: %v", err)
+	}
+
+	lines := strings.Split(strings.Replace(string(out), "\r\n", "\n", -1), "\n")
+	appKey = strings.TrimSpace(lines[0])
+	if appKey == "" {
+		return "", "", errors.New("creds-command didn't print an application key")
+	}
+	for _, line := range lines[1:] {
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) == 2 && credsCommandKeyIDs[strings.ToLower(strings.TrimSpace(fields[0]))] {
+			keyID = strings.TrimSpace(fields[1])
+		}
+	}
+	return keyID, appKey, nil
+}
+
+// getSpareKey reads the nth application key, which is tried when the ones
+// before it stop working. The key is empty once there are no more.
+func getSpareKey(e configSource, n int) (key appKey, err error) {
+	suffix := strconv.Itoa(n)
+
+	key.keyID, key.appKey = os.Getenv("B2_KEY_ID_"+suffix), os.Getenv("B2_APP_KEY_"+suffix)
+	if key.appKey != "" {
+		key.save = true
+		return key, nil
+	}
+
+	key.appKey, err = e.GetConfig("appkey-" + suffix)
+	if key.appKey != "" && err == nil {
+		key.keyID, err = e.GetConfig("appkeyid-" + suffix)
+		key.save = true
+		key.clearConfig = true
+	}
+	if key.appKey == "" && err == nil {
+		key.keyID, key.appKey, err = e.GetCreds("b2_appkey_" + suffix)
+	}
+	return key, err
+}
+
+// saveCreds saves what getCreds read from somewhere other than the creds and
+// settings it is kept in, during initremote or enableremote. bucketName is
+// the name of the bucket that was opened.
+func saveCreds(e configSource, config configValues, bucketName string) error {
+	if config.saveCreds {
+		err := e.SetCreds("b2_appkey", config.keyID, config.appKey)
+		if err != nil {
+			return err
+		}
+	}
+	if config.clearKeyConfig {
+		err := clearConfig(e, "appkey", "appkeyid")
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, key := range config.spareKeys {
+		suffix := strconv.Itoa(i + 2)
+		if key.save {
+			err := e.SetCreds("b2_appkey_"+suffix, key.keyID, key.appKey)
+			if err != nil {
+				return err
+			}
+		}
+		if key.clearConfig {
+			err := clearConfig(e, "appkey-"+suffix, "appkeyid-"+suffix)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if config.saveSSEKey {
+		err := e.SetCreds("b2_ssekey", "", config.sseKey)
+		if err != nil {
+			return err
+		}
+	}
+	if config.clearSSEKeyConfig {
+		err := clearConfig(e, "sse-key")
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.saveBucket {
+		if config.buckets != "" {
+			return e.SetConfig("buckets", config.buckets)
+		}
+		return e.SetConfig("bucket", bucketName)
+	}
+
+	return nil
+}
+
+// clearConfig takes secrets out of the settings once they're in the creds.
+func clearConfig(e configSource, names ...string) error {
+	for _, name := range names {
+		err := e.SetConfig(name, "")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// credsStorage describes where git-annex keeps the creds, which follows from
+// the embedcreds and encryption settings of the remote.
+func credsStorage(embedCreds, encryption string) string {
+	embedded := embedCreds == "yes"
+	if embedCreds == "" {
+		switch encryption {
+		case "hybrid", "pubkey", "sharedpubkey":
+			embedded = true
+		}
+	}
+	encrypted := encryption != "" && encryption != "none"
+
+	switch {
+	case embedded && encrypted:
+		return "embedded in the git-annex branch, encrypted"
+	case embedded:
+		return "embedded in the git-annex branch"
+	default:
+		return "local to this repository"
+	}
+}
@@ -23,7 +23,7 @@
       /.github/
     '' ] ./.;
 
-    modSha256 = "0xdmiwfkj84rh81w5wkd8cnvg0vsv5jv748l5ggj038bq0hmvrp2";
+    modSha256 = "0sdxnk06a04sf8n82y9gbplh6avsnh2fipaplzrfh34w232j9jmz";
   } // optionalAttrs enableStatic {
     CGO_ENABLED = "0";
 
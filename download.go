@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/arcnmx/go-git-annex-external/external"
+	"github.com/kothar/go-backblaze"
+)
+
+// Files are only split into ranges of at least this size; below it the cost
+// of the extra requests outweighs any gain in throughput.
+const minDownloadPartSize = 8 << 20
+
+// downloadParallel fetches b2file from offset onwards into fh using up to
+// downloadConcurrency ranged requests at once.
+func (be *B2Ext) downloadParallel(e *external.External, fh *os.File, b2file *backblaze.File, offset int64) error {
+	remaining := b2file.ContentLength - offset
+	parts := be.downloadConcurrency
+	if max := remaining / minDownloadPartSize; int64(parts) > max {
+		parts = int(max)
+	}
+	partSize := remaining / int64(parts)
+
+	ranges := make([]backblaze.FileRange, parts)
+	written := make([]int64, parts)
+	errs := make(chan error, parts)
+	for i := range ranges {
+		ranges[i].Start = offset + int64(i)*partSize
+		ranges[i].End = ranges[i].Start + partSize - 1
+		if i == parts-1 {
+			ranges[i].End = b2file.ContentLength - 1
+		}
+
+		go func(i int) {
+			errs <- be.downloadPart(fh, b2file, &ranges[i], &written[i])
+		}(i)
+	}
+
+	progress := func() int64 {
+		n := offset
+		for i := range written {
+			n += atomic.LoadInt64(&written[i])
+		}
+		return n
+	}
+
+	ticker := time.NewTicker(external.ProgressTimeInterval)
+	defer ticker.Stop()
+
+	var err error
+	for pending := parts; pending > 0; {
+		select {
+		case partErr := <-errs:
+			pending--
+			if partErr != nil && err == nil {
+				err = partErr
+			}
+		case <-ticker.C:
+			e.Progress(progress())
+		}
+	}
+
+	if err != nil {
+		// Drop everything after the first gap so that a retry can resume
+		// from the end of the file without leaving holes in it.
+		contiguous := offset
+		for i := range ranges {
+			n := atomic.LoadInt64(&written[i])
+			contiguous += n
+			if n != ranges[i].End-ranges[i].Start+1 {
+				break
+			}
+		}
+		if truncErr := fh.Truncate(contiguous); truncErr != nil {
+			e.Debug("couldn't truncate partial download: " + truncErr.Error())
+		}
+		return err
+	}
+
+	e.Progress(progress())
+	return nil
+}
+
+func (be *B2Ext) downloadPart(fh *os.File, b2file *backblaze.File, fileRange *backblaze.FileRange, written *int64) error {
+	var rc io.ReadCloser
+	var err error
+	if be.downloadURL != "" {
+		// Parts can only be fetched by name through download-url, so make
+		// sure they all come from the same version.
+		var part *backblaze.File
+		part, rc, err = be.downloadByName(b2file.Name, fileRange)
+		if err == nil && part.ID != b2file.ID {
+			rc.Close()
+			return fmt.Errorf("%v changed during download", b2file.Name)
+		}
+	} else if be.s3 != nil {
+		_, rc, err = be.s3.getObject(b2file.Name, b2file.ID, fileRange)
+	} else if be.ownDownloads() {
+		_, rc, err = be.downloadByID(b2file.ID, fileRange)
+	} else {
+		_, rc, err = be.client().DownloadFileRangeByID(b2file.ID, fileRange)
+	}
+	if rc != nil {
+		defer rc.Close()
+	}
+	if err != nil {
+		return transient(err)
+	}
+
+	_, err = be.copyContents(&offsetWriter{w: fh, offset: fileRange.Start, n: written}, limitReader(countingReader{transientReader{rc}}, be.downloadRate))
+	return err
+}
+
+// offsetWriter writes sequentially into w starting at offset, keeping a count
+// of the bytes written that is safe to read concurrently.
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+	n      *int64
+}
+
+func (ow *offsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.w.WriteAt(p, ow.offset+atomic.LoadInt64(ow.n))
+	atomic.AddInt64(ow.n, int64(n))
+	return n, err
+}
+
+// downloadVerifier hashes a download as it is written to disk, so that it can
+// be checked against the SHA1 that B2 holds for the file.
+type downloadVerifier struct {
+	sha hash.Hash
+	n   int64
+}
+
+func newDownloadVerifier() *downloadVerifier {
+	return &downloadVerifier{
+		sha: sha1.New(),
+	}
+}
+
+func (v *downloadVerifier) Write(p []byte) (int, error) {
+	n, err := v.sha.Write(p)
+	v.n += int64(n)
+	return n, err
+}
+
+// catchUp makes the verifier account for the first offset bytes of fh,
+// rereading them if they've changed since they were last seen.
+func (v *downloadVerifier) catchUp(fh *os.File, offset int64) error {
+	if v.n > offset {
+		v.sha.Reset()
+		v.n = 0
+	}
+
+	_, err := io.Copy(v, io.NewSectionReader(fh, v.n, offset-v.n))
+	if err != nil {
+		return fmt.Errorf("couldn't hash partial download: %v", err)
+	}
+	return nil
+}
+
+// verify checks the complete contents of fh against the SHA1 of b2file.
+func (v *downloadVerifier) verify(fh *os.File, b2file *backblaze.File) error {
+	wantSHA := contentSHA1(b2file)
+	if wantSHA == "" {
+		// Nothing to compare against; git-annex will still check the key.
+		return nil
+	}
+
+	size, err := fh.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	err = v.catchUp(fh, size)
+	if err != nil {
+		return err
+	}
+
+	haveSHA := hex.EncodeToString(v.sha.Sum(nil))
+	if haveSHA != wantSHA {
+		return fmt.Errorf("downloaded file has SHA1 %v, expected %v", haveSHA, wantSHA)
+	}
+	return nil
+}
+
+// contentSHA1 returns the hex SHA1 of the whole of b2file, or "" if B2
+// doesn't know it. Large files uploaded in parts only carry their SHA1 in
+// the large_file_sha1 file info, if at all.
+func contentSHA1(b2file *backblaze.File) string {
+	sha := strings.TrimPrefix(b2file.ContentSha1, "unverified:")
+	if sha == "" || sha == "none" {
+		sha = b2file.FileInfo["large_file_sha1"]
+	}
+	return strings.ToLower(sha)
+}
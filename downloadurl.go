@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/kothar/go-backblaze"
+)
+
+// fileURL returns the URL that name is downloaded from, which is on the
+// download-url host if one is set instead of the native B2 download host.
+func (be *B2Ext) fileURL(name string) (string, error) {
+	if be.downloadURL == "" {
+		return be.bucket().FileURL(name)
+	}
+
+	u := &url.URL{Path: "/file/" + be.bucket().Name + "/" + name}
+	return be.downloadURL + u.EscapedPath(), nil
+}
+
+// ownDownloads reports whether downloads have to be made here rather than by
+// go-backblaze, which can't send them anywhere but the B2 download host or
+// add the headers for SSE-C.
+func (be *B2Ext) ownDownloads() bool {
+	return be.downloadURL != "" || be.sse.mode == sseC
+}
+
+// downloadByName is Bucket.DownloadFileRangeByName, but fetches the file from
+// download-url if it is set. Public buckets are fetched without authorization
+// so that a CDN in front of them can cache the response.
+func (be *B2Ext) downloadByName(name string, fileRange *backblaze.FileRange) (*backblaze.File, io.ReadCloser, error) {
+	fileURL, err := be.fileURL(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return be.downloadFrom(fileURL, be.bucket().BucketType != backblaze.AllPublic, fileRange)
+}
+
+// downloadByID is B2.DownloadFileRangeByID.
+func (be *B2Ext) downloadByID(fileID string, fileRange *backblaze.FileRange) (*backblaze.File, io.ReadCloser, error) {
+	api, err := be.api()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fileURL := api.downloadURL + b2API + "b2_download_file_by_id?fileId=" + url.QueryEscape(fileID)
+	return be.downloadFrom(fileURL, true, fileRange)
+}
+
+func (be *B2Ext) downloadFrom(fileURL string, authorize bool, fileRange *backblaze.FileRange) (*backblaze.File, io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", fileURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if authorize {
+		api, err := be.api()
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Authorization", api.token)
+	}
+	if fileRange != nil {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", fileRange.Start, fileRange.End))
+	}
+	be.sse.setHeaders(req.Header, "X-Bz-", false)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, transient(err)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, nil, parseResponse(resp, nil)
+	}
+
+	return fileFromHeaders(resp.Header), resp.Body, nil
+}
+
+// fileFromHeaders describes a file from the headers B2 sends along with its
+// contents. A CDN may not pass all of them on, which leaves the file without
+// a SHA1 to verify the download against.
+func fileFromHeaders(h http.Header) *backblaze.File {
+	b2file := &backblaze.File{
+		ID:          h.Get("X-Bz-File-Id"),
+		ContentSha1: h.Get("X-Bz-Content-Sha1"),
+		ContentType: h.Get("Content-Type"),
+		FileInfo:    make(map[string]string),
+	}
+
+	b2file.Name, _ = url.QueryUnescape(h.Get("X-Bz-File-Name"))
+	b2file.ContentLength, _ = strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	for k, v := range h {
+		if strings.HasPrefix(k, "X-Bz-Info-") && len(v) > 0 {
+			// net/http has recapitalised the names, which B2 keeps in
+			// lower case.
+			key, _ := url.QueryUnescape(strings.ToLower(strings.TrimPrefix(k, "X-Bz-Info-")))
+			value, _ := url.QueryUnescape(v[0])
+			b2file.FileInfo[key] = value
+		}
+	}
+
+	return b2file
+}
+
+// headFile looks name up with a HEAD request for its download, which B2 bills
+// as class B where listing it is class C. A hidden file is not found, just as
+// it isn't listed.
+func (be *B2Ext) headFile(name string) (found bool, fileID string, err error) {
+	u := &url.URL{Path: "/file/" + be.bucket().Name + "/" + name}
+	for i := 0; ; i++ {
+		api, err := be.api()
+		if err != nil {
+			return false, "", err
+		}
+
+		req, err := http.NewRequest("HEAD", api.downloadURL+u.EscapedPath(), nil)
+		if err != nil {
+			return false, "", err
+		}
+		req.Header.Set("Authorization", api.token)
+		be.sse.setHeaders(req.Header, "X-Bz-", false)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return false, "", transient(err)
+		}
+		resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return true, resp.Header.Get("X-Bz-File-Id"), nil
+		case http.StatusNotFound:
+			return false, "", nil
+		case http.StatusUnauthorized:
+			// There's no body to say why, so it's taken to be an
+			// expired token the first time.
+			if i == 0 {
+				be.apiMu.Lock()
+				if be.apiClient == api {
+					be.apiClient = nil
+				}
+				be.apiMu.Unlock()
+				continue
+			}
+		}
+		return false, "", &backblaze.B2Error{
+			Status:  resp.StatusCode,
+			Code:    "UNKNOWN",
+			Message: resp.Status,
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/arcnmx/go-git-annex-external/external"
+)
+
+// handleExport implements the exporttree=yes part of the protocol, which
+// go-git-annex-external leaves to Unhandled. Exported files are stored under
+// the prefix by their path in the tree, so that a public bucket can be browsed
+// like the repository itself.
+func (be *B2Ext) handleExport(e *external.External, request, fields string) error {
+	out := e.Writer()
+
+	switch request {
+	case "EXPORTSUPPORTED":
+		fmt.Fprintf(out, "EXPORTSUPPORTED-SUCCESS\n")
+
+	case "EXPORT":
+		// Names the file that the next export request in this job operates on.
+		be.mu.Lock()
+		if be.exportNames == nil {
+			be.exportNames = make(map[*external.External]string)
+		}
+		be.exportNames[e] = fields
+		be.mu.Unlock()
+
+	case "TRANSFEREXPORT":
+		args := strings.SplitN(fields, " ", 3)
+		if len(args) != 3 {
+			return errors.New("less than 3 fields in TRANSFEREXPORT")
+		}
+		direction, key, file := args[0], args[1], args[2]
+		name := be.prefix + be.takeExportName(e)
+
+		var err error
+		switch direction {
+		case "STORE":
+			_, err = be.storeFile(e, name, key, file)
+		case "RETRIEVE":
+			err = be.retrieveFile(e, name, "", file)
+		default:
+			return external.ErrUnsupportedRequest
+		}
+		if err != nil {
+			fmt.Fprintf(out, "TRANSFER-FAILURE %s %s %s\n", direction, key, oneLine(err.Error()))
+		} else {
+			fmt.Fprintf(out, "TRANSFER-SUCCESS %s %s\n", direction, key)
+		}
+
+	case "CHECKPRESENTEXPORT":
+		key := fields
+		found, err := be.checkPresent(be.prefix + be.takeExportName(e))
+		switch {
+		case err != nil:
+			fmt.Fprintf(out, "CHECKPRESENT-UNKNOWN %s %s\n", key, oneLine(err.Error()))
+		case found:
+			fmt.Fprintf(out, "CHECKPRESENT-SUCCESS %s\n", key)
+		default:
+			fmt.Fprintf(out, "CHECKPRESENT-FAILURE %s\n", key)
+		}
+
+	case "REMOVEEXPORT":
+		key := fields
+		err := be.removeFile(be.prefix + be.takeExportName(e))
+		if err != nil {
+			fmt.Fprintf(out, "REMOVE-FAILURE %s %s\n", key, oneLine(err.Error()))
+		} else {
+			fmt.Fprintf(out, "REMOVE-SUCCESS %s\n", key)
+		}
+
+	case "REMOVEEXPORTDIRECTORY":
+		err := be.removeExportDirectory(be.prefix + strings.TrimSuffix(fields, "/") + "/")
+		if err != nil {
+			e.Debug(fmt.Sprintf("couldn't remove export directory %v: %v", fields, err))
+			fmt.Fprintf(out, "REMOVEEXPORTDIRECTORY-FAILURE\n")
+		} else {
+			fmt.Fprintf(out, "REMOVEEXPORTDIRECTORY-SUCCESS\n")
+		}
+
+	case "RENAMEEXPORT":
+		args := strings.SplitN(fields, " ", 2)
+		if len(args) != 2 {
+			return errors.New("less than 2 fields in RENAMEEXPORT")
+		}
+		key, newName := args[0], args[1]
+		name := be.takeExportName(e)
+
+		err := be.renameExport(e, key, be.prefix+name, be.prefix+newName)
+		if err != nil {
+			e.Debug(fmt.Sprintf("couldn't rename %v to %v: %v", name, newName, err))
+			fmt.Fprintf(out, "RENAMEEXPORT-FAILURE %s\n", key)
+		} else {
+			fmt.Fprintf(out, "RENAMEEXPORT-SUCCESS %s\n", key)
+		}
+
+	default:
+		return external.ErrUnsupportedRequest
+	}
+
+	return nil
+}
+
+// takeExportName returns the name given by the job's EXPORT request, and
+// forgets it, since it only applies to the one request that follows.
+func (be *B2Ext) takeExportName(e *external.External) string {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	name := be.exportNames[e]
+	delete(be.exportNames, e)
+	return name
+}
+
+// removeExportDirectory removes every file below dir. B2 has no directories
+// of its own, so there is nothing else to clean up once they're gone.
+func (be *B2Ext) removeExportDirectory(dir string) error {
+	startFileName := dir
+	for {
+		response, err := be.bucket().ListFileNamesWithPrefix(startFileName, 1000, dir, "")
+		if err != nil {
+			return fmt.Errorf("couldn't list filenames: %v", err)
+		}
+
+		for _, file := range response.Files {
+			err = be.removeFile(file.Name)
+			if err != nil {
+				return err
+			}
+		}
+
+		if response.NextFileName == "" {
+			return nil
+		}
+		startFileName = response.NextFileName
+	}
+}
+
+// oneLine makes a message safe to send as part of a protocol reply.
+func oneLine(s string) string {
+	return strings.Replace(s, "\n", " ", -1)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/kothar/go-backblaze"
+)
+
+// cliConfig answers GETCONFIG from command line flags when running outside
+// of git-annex. Credentials have to come from the environment.
+type cliConfig map[string]string
+
+func (c cliConfig) GetConfig(name string) (string, error) {
+	return c[name], nil
+}
+
+func (c cliConfig) GetCreds(name string) (string, string, error) {
+	return "", "", nil
+}
+
+func (c cliConfig) SetConfig(name, value string) error {
+	return nil
+}
+
+func (c cliConfig) SetCreds(name, user, password string) error {
+	return nil
+}
+
+func runGC(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: git-annex-remote-b2 gc [options]\n\n")
+		fmt.Fprintf(flags.Output(), "Deletes hidden and superseded file versions and cancels abandoned large\n")
+		fmt.Fprintf(flags.Output(), "file uploads under the remote's prefix. Credentials are read from the\n")
+		fmt.Fprintf(flags.Output(), "B2_ACCOUNT_ID, B2_KEY_ID and B2_APP_KEY environment variables.\n\n")
+		flags.PrintDefaults()
+	}
+	bucket := flags.String("bucket", "", "B2 bucket name (or B2_BUCKET environment variable)")
+	prefix := flags.String("prefix", "", "object key prefix of the remote")
+	layout := flags.String("layout", "", "layout of the keys under the prefix, flat or hashdir (or B2_LAYOUT environment variable)")
+	dryRun := flags.Bool("n", false, "only print what would be deleted")
+	minAge := flags.Duration("min-age", 24*time.Hour, "leave unfinished large files younger than this alone")
+	flags.Parse(args)
+
+	be := &B2Ext{}
+	err := be.setup(cliConfig{
+		"bucket": *bucket,
+		"prefix": *prefix,
+		"layout": *layout,
+	}, false)
+	if err != nil {
+		return err
+	}
+
+	return be.gc(os.Stdout, *dryRun, *minAge)
+}
+
+// gc deletes every version under the prefix other than the current version
+// of each file, and cancels unfinished large files older than minAge.
+func (be *B2Ext) gc(out io.Writer, dryRun bool, minAge time.Duration) error {
+	var deleted, cancelled int
+	defer func() {
+		fmt.Fprintf(out, "%v file versions deleted, %v unfinished large files cancelled\n", deleted, cancelled)
+	}()
+
+	// The versions of each name are collected before any of them are
+	// deleted, since whether a hide marker can go depends on what is kept
+	// below it.
+	var versions []fileVersion
+	collect := func() error {
+		n, err := be.gcVersions(out, dryRun, versions)
+		deleted += n
+		versions = versions[:0]
+		return err
+	}
+
+	startFileName, startFileID := be.prefix, ""
+	for {
+		response, err := be.listFileVersions(startFileName, startFileID, 1000, be.prefix, be.keyDelimiter())
+		if err != nil {
+			return fmt.Errorf("couldn't list file versions: %v", err)
+		}
+
+		for _, file := range response.Files {
+			switch {
+			case !be.isKeyName(file.Name):
+				// Something else under the prefix, which the hashdir
+				// layout can't leave out of the listing.
+			case file.Action == "start":
+				uploaded := time.Unix(0, file.UploadTimestamp*int64(time.Millisecond))
+				if time.Since(uploaded) < minAge {
+					continue
+				}
+
+				fmt.Fprintf(out, "cancel %v (%v)\n", file.Name, file.ID)
+				if !dryRun {
+					err = be.cancelLargeFile(file.ID)
+					if err != nil {
+						return fmt.Errorf("couldn't cancel large file %#v: %v", file.ID, err)
+					}
+				}
+				cancelled++
+
+			case file.Action == backblaze.Upload || file.Action == backblaze.Hide:
+				if len(versions) > 0 && versions[0].Name != file.Name {
+					err = collect()
+					if err != nil {
+						return err
+					}
+				}
+				versions = append(versions, file)
+			}
+		}
+
+		if response.NextFileName == "" {
+			return collect()
+		}
+		startFileName, startFileID = response.NextFileName, response.NextFileID
+	}
+}
+
+// gcVersions deletes what isn't needed of versions, the uploads and hide
+// markers of one name listed newest first, and returns how many were deleted.
+func (be *B2Ext) gcVersions(out io.Writer, dryRun bool, versions []fileVersion) (int, error) {
+	if len(versions) == 0 {
+		return 0, nil
+	}
+
+	keep := make([]bool, len(versions))
+	// The newest upload is the one git-annex sees.
+	keep[0] = versions[0].Action == backblaze.Upload
+	retained := false
+	for i, file := range versions[1:] {
+		if time.Now().Before(file.retainedUntil()) {
+			fmt.Fprintf(out, "retained %v (%v)\n", file.Name, file.ID)
+			keep[i+1] = true
+			retained = true
+		}
+	}
+	if retained {
+		// A hide marker has to stay for as long as anything below it does,
+		// or the key would reappear.
+		keep[0] = true
+	}
+
+	// Oldest first, so that the newest version is the last to go should
+	// any of them fail.
+	deleted := 0
+	for i := len(versions) - 1; i >= 0; i-- {
+		if keep[i] {
+			continue
+		}
+		file := versions[i]
+		fmt.Fprintf(out, "delete %v (%v)\n", file.Name, file.ID)
+		if !dryRun {
+			err := be.deleteVersion(file.Name, file.ID)
+			if err != nil {
+				return deleted, fmt.Errorf("couldn't delete file version %#v: %v", file.ID, err)
+			}
+		}
+		deleted++
+	}
+	return deleted, nil
+}
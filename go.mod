@@ -6,6 +6,7 @@ require (
 	github.com/arcnmx/go-git-annex-external v0.0.0-20200205211336-79516aca6ef9
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b // indirect
 	github.com/google/readahead v0.0.0-20161222183148-eaceba169032 // indirect
+	github.com/klauspost/compress v1.11.13
 	github.com/kothar/go-backblaze v0.0.0-20191215213626-7594ed38700f
 	github.com/pquerna/ffjson v0.0.0-20190930134022-aa0246cd15f7 // indirect
 	gopkg.in/kothar/go-backblaze.v0 v0.0.0-20191215213626-7594ed38700f
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/arcnmx/go-git-annex-external/external"
+	"github.com/kothar/go-backblaze"
+)
+
+// handleImport implements the importtree=yes part of the protocol. The content
+// identifier of a file is the B2 file ID of its current version, which changes
+// whenever anything else uploads over it.
+func (be *B2Ext) handleImport(e *external.External, request, fields string) error {
+	out := e.Writer()
+
+	switch request {
+	case "IMPORTSUPPORTED":
+		fmt.Fprintf(out, "IMPORTSUPPORTED-SUCCESS\n")
+
+	case "LISTIMPORTABLECONTENTS":
+		err := be.listImportableContents(e)
+		if err != nil {
+			fmt.Fprintf(out, "LISTIMPORTABLECONTENTS-FAILURE %s\n", oneLine(err.Error()))
+		}
+
+	case "RETRIEVEEXPORTEXPECTED":
+		args := strings.SplitN(fields, " ", 2)
+		if len(args) != 2 {
+			return errors.New("less than 2 fields in RETRIEVEEXPORTEXPECTED")
+		}
+		cid, file := args[0], args[1]
+
+		err := be.retrieveFile(e, be.prefix+be.takeExportName(e), cid, file)
+		if err != nil {
+			fmt.Fprintf(out, "RETRIEVEEXPORTEXPECTED-FAILURE %s\n", oneLine(err.Error()))
+		} else {
+			fmt.Fprintf(out, "RETRIEVEEXPORTEXPECTED-SUCCESS\n")
+		}
+
+	case "STOREEXPORTEXPECTED":
+		args := strings.SplitN(fields, " ", 3)
+		if len(args) != 3 {
+			return errors.New("less than 3 fields in STOREEXPORTEXPECTED")
+		}
+		cid, key, file := args[0], args[1], args[2]
+
+		newCID, err := be.storeExpected(e, be.takeExportName(e), cid, key, file)
+		if err != nil {
+			fmt.Fprintf(out, "STOREEXPORTEXPECTED-FAILURE %s\n", oneLine(err.Error()))
+		} else {
+			fmt.Fprintf(out, "STOREEXPORTEXPECTED-SUCCESS %s\n", newCID)
+		}
+
+	case "REMOVEEXPORTEXPECTED":
+		err := be.removeExpected(be.takeExportName(e), fields)
+		if err != nil {
+			fmt.Fprintf(out, "REMOVEEXPORTEXPECTED-FAILURE %s\n", oneLine(err.Error()))
+		} else {
+			fmt.Fprintf(out, "REMOVEEXPORTEXPECTED-SUCCESS\n")
+		}
+
+	case "REMOVEEXPORTDIRECTORYWHENEMPTY":
+		// Directories only exist in B2 for as long as there are files in them.
+		fmt.Fprintf(out, "REMOVEEXPORTDIRECTORYWHENEMPTY-SUCCESS\n")
+
+	default:
+		return external.ErrUnsupportedRequest
+	}
+
+	return nil
+}
+
+// listImportableContents reports every file under the prefix to git-annex.
+func (be *B2Ext) listImportableContents(e *external.External) error {
+	// Spool the reply as the pages of the listing come in, so that a
+	// failure partway through can still be reported instead of an
+	// incomplete tree, without holding the whole listing in memory.
+	dir, err := be.workDir(e, "tmp")
+	if err != nil {
+		return err
+	}
+	spool, err := ioutil.TempFile(dir, "import")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	w := bufio.NewWriter(spool)
+	startFileName := be.prefix
+	for {
+		response, err := be.bucket().ListFileNamesWithPrefix(startFileName, 1000, be.prefix, "")
+		if err != nil {
+			return fmt.Errorf("couldn't list filenames: %v", err)
+		}
+
+		for _, file := range response.Files {
+			if file.Action == backblaze.Upload {
+				fmt.Fprintf(w, "CONTENT %d %s\n", file.ContentLength, oneLine(strings.TrimPrefix(file.Name, be.prefix)))
+				fmt.Fprintf(w, "CONTENTIDENTIFIER %s\n", file.ID)
+			}
+		}
+
+		if response.NextFileName == "" {
+			break
+		}
+		startFileName = response.NextFileName
+	}
+
+	err = w.Flush()
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't spool the listing: %v", err)
+	}
+
+	out := e.Writer()
+	_, err = be.copyContents(out, spool)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "END\n")
+
+	return nil
+}
+
+// currentCID returns the content identifier of the exported file exportName,
+// or "" if it doesn't exist. It is there to catch changes made by something
+// else, so the bucket is always listed rather than the caches believed, and
+// whatever is found replaces what they had.
+func (be *B2Ext) currentCID(exportName string) (string, error) {
+	name := be.prefix + exportName
+	found, fileID, err := be.listFile(name)
+	if err != nil {
+		return "", fmt.Errorf("couldn't list filenames: %v", err)
+	}
+	if !found {
+		be.fileRemoved(name)
+		return "", nil
+	}
+	be.fileStored(name, fileID)
+	return fileID, nil
+}
+
+// storeExpected exports file as exportName as long as whatever is there now is
+// the content git-annex last saw, and returns the new content identifier.
+func (be *B2Ext) storeExpected(e *external.External, exportName, cid, key, file string) (string, error) {
+	current, err := be.currentCID(exportName)
+	if err != nil {
+		return "", err
+	}
+	if current != "" && current != cid {
+		return "", fmt.Errorf("%v was modified in the bucket since it was last imported", exportName)
+	}
+
+	return be.storeFile(e, be.prefix+exportName, key, file)
+}
+
+// removeExpected removes the exported file exportName as long as it hasn't
+// been changed since git-annex last saw it.
+func (be *B2Ext) removeExpected(exportName, cid string) error {
+	current, err := be.currentCID(exportName)
+	if err != nil {
+		return err
+	}
+	if current == "" {
+		return nil
+	}
+	if current != cid {
+		return fmt.Errorf("%v was modified in the bucket since it was last imported", exportName)
+	}
+
+	return be.removeFile(be.prefix + exportName)
+}
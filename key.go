@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// Layouts of the keys under the prefix.
+const (
+	layoutFlat    = "flat"
+	layoutHashDir = "hashdir"
+)
+
+// keyName returns the name that key is stored under.
+func (be *B2Ext) keyName(key string) string {
+	if be.layout == layoutHashDir {
+		return be.prefix + hashDirLower(key) + key
+	}
+	return be.prefix + key
+}
+
+// isKeyName reports whether name could be where a key is stored, rather than
+// something else under the prefix.
+func (be *B2Ext) isKeyName(name string) bool {
+	if !strings.HasPrefix(name, be.prefix) {
+		return false
+	}
+	parts := strings.Split(strings.TrimPrefix(name, be.prefix), "/")
+	if be.layout == layoutHashDir {
+		return len(parts) == 3 && len(parts[0]) == 3 && len(parts[1]) == 3
+	}
+	return len(parts) == 1
+}
+
+// keyDelimiter is the delimiter to list the keys under the prefix with. Keys
+// never contain a slash, so with the flat layout the delimiter keeps other
+// remotes nested below our prefix (or sharing the top level of the bucket)
+// from being listed along with them.
+func (be *B2Ext) keyDelimiter() string {
+	if be.layout == layoutHashDir {
+		return ""
+	}
+	return "/"
+}
+
+// hashDirLower is the two levels of directories that git-annex's directory
+// special remote stores key in, from the MD5 of the key without its chunk
+// fields so that every chunk of a file ends up in the same place.
+func hashDirLower(key string) string {
+	sum := md5.Sum([]byte(nonChunkKey(key)))
+	h := hex.EncodeToString(sum[:])
+	return h[:3] + "/" + h[3:6] + "/"
+}
+
+func nonChunkKey(key string) string {
+	parts := strings.SplitN(key, "--", 2)
+	if len(parts) != 2 {
+		return key
+	}
+
+	fields := strings.Split(parts[0], "-")
+	kept := []string{fields[0]}
+	for _, field := range fields[1:] {
+		if field != "" && (field[0] == 'S' || field[0] == 'C') {
+			continue
+		}
+		kept = append(kept, field)
+	}
+	return strings.Join(kept, "-") + "--" + parts[1]
+}
+
+// keySHA1 extracts the content SHA1 from a SHA1 or SHA1E git-annex key, along
+// with the size recorded in the key (-1 if absent).
+//
+// Chunk keys carry the digest of the whole file rather than of the chunk, so
+// they never match.
+func keySHA1(key string) (sha []byte, size int64, ok bool) {
+	parts := strings.SplitN(key, "--", 2)
+	if len(parts) != 2 {
+		return nil, 0, false
+	}
+
+	fields := strings.Split(parts[0], "-")
+	backend := fields[0]
+	if backend != "SHA1" && backend != "SHA1E" {
+		return nil, 0, false
+	}
+
+	size = -1
+	for _, field := range fields[1:] {
+		if field == "" {
+			return nil, 0, false
+		}
+
+		switch field[0] {
+		case 's':
+			n, err := strconv.ParseInt(field[1:], 10, 64)
+			if err != nil {
+				return nil, 0, false
+			}
+			size = n
+		case 'S', 'C':
+			return nil, 0, false
+		}
+	}
+
+	digest := parts[1]
+	if backend == "SHA1E" {
+		if i := strings.IndexByte(digest, '.'); i >= 0 {
+			digest = digest[:i]
+		}
+	}
+	if len(digest) != 40 {
+		return nil, 0, false
+	}
+
+	sha, err := hex.DecodeString(digest)
+	if err != nil {
+		return nil, 0, false
+	}
+
+	return sha, size, true
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kothar/go-backblaze"
+)
+
+// appKey is one of the application keys that the remote can authorize with.
+type appKey struct {
+	keyID  string
+	appKey string
+	// Whether it is to be saved in the creds, and taken out of the settings.
+	save        bool
+	clearConfig bool
+}
+
+// String describes key for the log without giving it away.
+func (k appKey) String() string {
+	if k.keyID == "" {
+		return "master application key"
+	}
+	return "application key " + k.keyID
+}
+
+// localSource is a configSource that can say where the remote keeps files of
+// its own; git-annex can, the command line can't.
+type localSource interface {
+	GetGitDir() (string, error)
+	GetUUID() (string, error)
+}
+
+// keyIndexFile returns the file that the index of the application key in use
+// is kept in, so that other processes start with the key that works rather
+// than being refused the revoked one first, or "" if e can't say where. It is
+// local to the repository, and named after the remote since a repository can
+// have several.
+func (be *B2Ext) keyIndexFile(e configSource) (string, error) {
+	local, ok := e.(localSource)
+	if !ok {
+		return "", nil
+	}
+	uuid, err := local.GetUUID()
+	if err != nil || uuid == "" {
+		return "", err
+	}
+	dir, err := be.workDir(local, "appkeys")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, uuid), nil
+}
+
+// loadKeyIndex returns the index of the application key that was last in use,
+// out of n keys.
+func loadKeyIndex(file string, n int) int {
+	if file == "" {
+		return 0
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0
+	}
+	index, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || index < 0 || index >= n {
+		return 0
+	}
+	return index
+}
+
+// saveKeyIndex records that the application key at index is the one in use.
+func saveKeyIndex(file string, index int) {
+	if file == "" {
+		return
+	}
+	err := ioutil.WriteFile(file, []byte(strconv.Itoa(index)+"\n"), 0644)
+	if err != nil {
+		logs.logf(levelInfo, "couldn't record the application key in use: %v", err)
+	}
+}
+
+// b2Auth is the authorization of the account, shared by every bucket the
+// remote is sharded across so that they authorize once and fail over together.
+type b2Auth struct {
+	// authMu guards the application keys, of which the one at appKeyIndex
+	// is in use, the go-backblaze client authorized with it, and the S3
+	// clients that sign with it.
+	authMu      sync.Mutex
+	b2          *backblaze.B2
+	appKeys     []appKey
+	appKeyIndex int
+	s3Clients   []*s3Client
+	// Where appKeyIndex is recorded; see keyIndexFile.
+	indexFile string
+
+	// apiMu guards apiClient.
+	apiMu     sync.Mutex
+	apiClient *apiClient
+}
+
+// authorizeKey makes a go-backblaze client that is authorized with key.
+func authorizeKey(accountID string, key appKey) (*backblaze.B2, error) {
+	return backblaze.NewB2(backblaze.Credentials{
+		AccountID:      accountID,
+		ApplicationKey: key.appKey,
+		KeyID:          key.keyID,
+	})
+}
+
+// client returns the go-backblaze client of the application key in use.
+func (auth *b2Auth) client() *backblaze.B2 {
+	auth.authMu.Lock()
+	defer auth.authMu.Unlock()
+	return auth.b2
+}
+
+// addS3Client has client sign with whichever key is in use from now on.
+func (auth *b2Auth) addS3Client(client *s3Client) {
+	auth.authMu.Lock()
+	defer auth.authMu.Unlock()
+
+	client.setKey(auth.b2.Credentials)
+	auth.s3Clients = append(auth.s3Clients, client)
+}
+
+// isUnauthorized reports whether B2 refused the application key itself, as it
+// does once the key has been deleted, rather than a token made from it.
+func isUnauthorized(err error) bool {
+	b2err, ok := err.(*backblaze.B2Error)
+	if !ok {
+		return false
+	}
+	switch b2err.Status {
+	case http.StatusUnauthorized:
+		// A bad token only needs authorizing again, which is when
+		// the key gets checked.
+		return b2err.Code == "unauthorized"
+	case http.StatusForbidden:
+		// The S3 API checks the key on every request.
+		return b2err.Code == "InvalidAccessKeyId"
+	}
+	return false
+}
+
+// failover switches to the next application key that B2 accepts, once the
+// one in use has been refused with cause. The keys are tried in order,
+// wrapping around, so that a key that was rotated out and back in can be
+// used again.
+// It must be called with authMu held.
+func (auth *b2Auth) failover(cause error) error {
+	err := cause
+	for i := 1; i < len(auth.appKeys); i++ {
+		n := (auth.appKeyIndex + i) % len(auth.appKeys)
+		key := auth.appKeys[n]
+
+		// go-backblaze reads the credentials of a client whenever it
+		// authorizes again, so they are never changed; the key gets a
+		// client of its own instead.
+		var b2 *backblaze.B2
+		b2, err = authorizeKey(auth.b2.AccountID, key)
+		if err == nil {
+			logs.logf(levelInfo, "failed over to %v", key)
+			notices.add(fmt.Sprintf("B2 refused the application key in use (%v), failed over to %v", cause, key))
+			auth.b2 = b2
+			auth.appKeyIndex = n
+			saveKeyIndex(auth.indexFile, n)
+			for _, client := range auth.s3Clients {
+				client.setKey(b2.Credentials)
+			}
+			auth.apiMu.Lock()
+			auth.apiClient = nil
+			auth.apiMu.Unlock()
+			return nil
+		}
+		if !isUnauthorized(err) {
+			return err
+		}
+		logs.logf(levelInfo, "%v was refused: %v", key, err)
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/kothar/go-backblaze"
+)
+
+func runLegalHold(args []string) error {
+	flags := flag.NewFlagSet("legal-hold", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: git-annex-remote-b2 legal-hold [options] on|off\n\n")
+		fmt.Fprintf(flags.Output(), "Places or lifts an Object Lock legal hold on every file version under the\n")
+		fmt.Fprintf(flags.Output(), "remote's prefix. Credentials are read from the B2_ACCOUNT_ID, B2_KEY_ID\n")
+		fmt.Fprintf(flags.Output(), "and B2_APP_KEY environment variables.\n\n")
+		flags.PrintDefaults()
+	}
+	bucket := flags.String("bucket", "", "B2 bucket name (or B2_BUCKET environment variable)")
+	prefix := flags.String("prefix", "", "object key prefix of the remote")
+	dryRun := flags.Bool("n", false, "only print what would be changed")
+	flags.Parse(args)
+
+	var hold bool
+	switch flags.Arg(0) {
+	case "on":
+		hold = true
+	case "off":
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	be := &B2Ext{}
+	err := be.setup(cliConfig{
+		"bucket": *bucket,
+		"prefix": *prefix,
+	}, false)
+	if err != nil {
+		return err
+	}
+
+	return be.setLegalHold(os.Stdout, hold, *dryRun)
+}
+
+// setLegalHold places or lifts a legal hold on every version under the
+// prefix, not only the current ones, so that nothing stored under it can be
+// deleted while the hold is on.
+func (be *B2Ext) setLegalHold(out io.Writer, hold bool, dryRun bool) error {
+	var updated int
+	defer func() {
+		fmt.Fprintf(out, "%v file versions updated\n", updated)
+	}()
+
+	startFileName, startFileID := be.prefix, ""
+	for {
+		response, err := be.listFileVersions(startFileName, startFileID, 1000, be.prefix, "")
+		if err != nil {
+			return fmt.Errorf("couldn't list file versions: %v", err)
+		}
+
+		for _, file := range response.Files {
+			if file.Action != backblaze.Upload {
+				continue
+			}
+
+			fmt.Fprintf(out, "update %v (%v)\n", file.Name, file.ID)
+			if !dryRun {
+				err = be.updateLegalHold(file.Name, file.ID, hold)
+				if err != nil {
+					return fmt.Errorf("couldn't update legal hold of file version %#v: %v", file.ID, err)
+				}
+			}
+			updated++
+		}
+
+		if response.NextFileName == "" {
+			return nil
+		}
+		startFileName, startFileID = response.NextFileName, response.NextFileID
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Object Lock retention modes. Governance retention can be lifted by a key
+// with the bypassGovernance capability, compliance retention by nobody.
+const (
+	retentionGovernance = "governance"
+	retentionCompliance = "compliance"
+)
+
+// fileLock is the Object Lock retention and legal hold given to each
+// uploaded file, which only work in a bucket that has Object Lock enabled.
+type fileLock struct {
+	mode      string
+	retention time.Duration
+	legalHold bool
+}
+
+// parseFileLock checks the retention-days, retention-mode and legal-hold
+// settings.
+func parseFileLock(days, mode, legalHold string) (fileLock, error) {
+	var l fileLock
+	switch legalHold {
+	case "", "off":
+	case "on":
+		l.legalHold = true
+	default:
+		return fileLock{}, fmt.Errorf("unknown legal hold %#v, expected on or off", legalHold)
+	}
+
+	if days == "" || days == "0" {
+		return l, nil
+	}
+
+	n, err := strconv.Atoi(days)
+	if err != nil || n < 0 {
+		return fileLock{}, fmt.Errorf("couldn't parse retention days %#v", days)
+	}
+
+	switch mode {
+	case "":
+		mode = retentionGovernance
+	case retentionGovernance, retentionCompliance:
+	default:
+		return fileLock{}, fmt.Errorf("unknown retention mode %#v, expected governance or compliance", mode)
+	}
+
+	l.mode = mode
+	l.retention = time.Duration(n) * 24 * time.Hour
+	return l, nil
+}
+
+func (l fileLock) String() string {
+	if l.retention == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%v days %v", int(l.retention/(24*time.Hour)), l.mode)
+}
+
+// setHeaders adds the retention of a file uploaded at now, and its legal
+// hold, to a native API upload.
+func (l fileLock) setHeaders(h http.Header, now time.Time) {
+	if l.legalHold {
+		h.Set("X-Bz-File-Legal-Hold", "on")
+	}
+	if l.retention == 0 {
+		return
+	}
+	until := now.Add(l.retention)
+	h.Set("X-Bz-File-Retention-Mode", l.mode)
+	h.Set("X-Bz-File-Retention-Retain-Until-Timestamp", strconv.FormatInt(until.UnixNano()/int64(time.Millisecond), 10))
+}
+
+type fileRetention struct {
+	Mode                 string `json:"mode"`
+	RetainUntilTimestamp int64  `json:"retainUntilTimestamp"`
+}
+
+// params returns the retention and legal hold of a file created at now by an
+// API call that takes them in its JSON request.
+func (l fileLock) params(now time.Time) (*fileRetention, string) {
+	var retention *fileRetention
+	if l.retention != 0 {
+		retention = &fileRetention{
+			Mode:                 l.mode,
+			RetainUntilTimestamp: now.Add(l.retention).UnixNano() / int64(time.Millisecond),
+		}
+	}
+	legalHold := ""
+	if l.legalHold {
+		legalHold = "on"
+	}
+	return retention, legalHold
+}
+
+// setS3Headers is setHeaders for an S3 PUT.
+func (l fileLock) setS3Headers(h http.Header, now time.Time) {
+	if l.legalHold {
+		h.Set("X-Amz-Object-Lock-Legal-Hold", "ON")
+	}
+	if l.retention == 0 {
+		return
+	}
+	until := now.Add(l.retention)
+	h.Set("X-Amz-Object-Lock-Mode", strings.ToUpper(l.mode))
+	h.Set("X-Amz-Object-Lock-Retain-Until-Date", until.UTC().Format(time.RFC3339))
+}
+
+// retainedUntil returns when the Object Lock retention of file ends, or the
+// zero time if it has none. A key that may not read retention is told none.
+func (file *fileVersion) retainedUntil() time.Time {
+	value := file.FileRetention.Value
+	if value == nil || value.Mode == "" {
+		return time.Time{}
+	}
+	return time.Unix(0, value.RetainUntilTimestamp*int64(time.Millisecond))
+}
+
+// checkRetained refuses to delete name while any version of it is still
+// retained, which B2 would otherwise refuse with a generic access_denied
+// part way through. Hiding it is never refused, so with delete-mode=hide
+// there is nothing to check.
+func (be *B2Ext) checkRetained(name string) error {
+	if !be.deleteVersions {
+		return nil
+	}
+	versions, err := be.listVersions(name)
+	if err != nil {
+		return err
+	}
+	return checkRetained(name, versions)
+}
+
+func checkRetained(name string, versions []fileVersion) error {
+	for i := range versions {
+		until := versions[i].retainedUntil()
+		if time.Now().Before(until) {
+			return fmt.Errorf("%v is retained by Object Lock until %v", name, until.UTC().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
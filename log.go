@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels, from least to most verbose.
+const (
+	levelError = iota
+	levelInfo
+	levelDebug
+	// Every line of the protocol, in both directions.
+	levelProtocol
+)
+
+var levelNames = []string{"error", "info", "debug", "protocol"}
+
+func parseLogLevel(s string) (int, error) {
+	if s == "" {
+		return levelDebug, nil
+	}
+	for level, name := range levelNames {
+		if s == name {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %#v, expected one of %v", s, strings.Join(levelNames, ", "))
+}
+
+// Settings whose values are as secret as credentials.
+var secretConfigs = map[string]bool{
+	"appkey":  true,
+	"sse-key": true,
+}
+
+func isSecretConfig(name string) bool {
+	// The spare application keys are appkey-2 and so on.
+	return secretConfigs[name] || strings.HasPrefix(name, "appkey-")
+}
+
+// logger writes timestamped lines to the log-file, with credentials taken
+// out. The protocol is logged by watching it go by rather than from where
+// requests are handled, so that the DEBUG messages sent to git-annex end up
+// there too.
+type logger struct {
+	mu      sync.Mutex
+	w       io.Writer
+	path    string
+	level   int
+	secrets []string
+	// Jobs whose next reply from git-annex is the value of a secret.
+	pending map[string]bool
+}
+
+var logs = &logger{}
+
+// open starts logging to path, or to stderr if it is "-", at the given
+// level. Opening the file that is already being logged to only changes the
+// level.
+func (l *logger) open(path string, level int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if path != l.path {
+		var w io.Writer = os.Stderr
+		if path != "-" {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				return err
+			}
+			w = f
+		}
+		if f, ok := l.w.(*os.File); ok && f != os.Stderr {
+			f.Close()
+		}
+		l.w = w
+		l.path = path
+	}
+	l.level = level
+	return nil
+}
+
+// secret makes sure that s never appears in the log.
+func (l *logger) secret(s string) {
+	if s == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.secrets = append(l.secrets, s)
+}
+
+func (l *logger) logf(level int, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.write(level, fmt.Sprintf(format, args...))
+}
+
+func (l *logger) write(level int, msg string) {
+	if l.w == nil || level > l.level {
+		return
+	}
+	for _, s := range l.secrets {
+		msg = strings.Replace(msg, s, "<redacted>", -1)
+	}
+	fmt.Fprintf(l.w, "%v %-8v %v\n", time.Now().Format("2006-01-02T15:04:05.000Z07:00"), levelNames[level], msg)
+}
+
+// protocolLine logs a line of the protocol, sent by the remote if fromRemote
+// is set and by git-annex otherwise.
+func (l *logger) protocolLine(line string, fromRemote bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.w == nil {
+		return
+	}
+
+	job, msg := "", line
+	if strings.HasPrefix(msg, "J ") {
+		if fields := strings.SplitN(msg, " ", 3); len(fields) == 3 {
+			job, msg = fields[1], fields[2]
+		}
+	}
+	request := strings.SplitN(msg, " ", 2)[0]
+
+	if fromRemote {
+		switch {
+		case request == "GETCREDS":
+			l.pendingSecret(job, true)
+		case request == "GETCONFIG":
+			l.pendingSecret(job, isSecretConfig(strings.TrimSpace(strings.TrimPrefix(msg, "GETCONFIG "))))
+		case request == "SETCREDS":
+			fields := strings.SplitN(msg, " ", 3)
+			if len(fields) == 3 {
+				line = strings.Replace(line, msg, fields[0]+" "+fields[1]+" <redacted>", 1)
+			}
+		}
+	} else if (request == "VALUE" || request == "CREDS") && l.pending[job] {
+		l.pendingSecret(job, false)
+		line = strings.Replace(line, msg, request+" <redacted>", 1)
+	}
+
+	level := levelProtocol
+	switch {
+	case !fromRemote:
+	case request == "DEBUG":
+		level = levelDebug
+	case request == "INFO":
+		level = levelInfo
+	case request == "ERROR" || strings.HasSuffix(request, "-FAILURE"):
+		level = levelError
+	}
+
+	direction := "<-"
+	if fromRemote {
+		direction = "->"
+	}
+	l.write(level, direction+" "+line)
+}
+
+func (l *logger) pendingSecret(job string, pending bool) {
+	if l.pending == nil {
+		l.pending = make(map[string]bool)
+	}
+	l.pending[job] = pending
+}
+
+// protocolLog is an io.Writer that logs each line written to it.
+type protocolLog struct {
+	fromRemote bool
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (pl *protocolLog) Write(p []byte) (int, error) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	pl.buf.Write(p)
+	for {
+		i := bytes.IndexByte(pl.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		line := string(pl.buf.Next(i + 1))
+		logs.protocolLine(strings.TrimRight(line, "\r\n"), pl.fromRemote)
+	}
+	return len(p), nil
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -10,6 +9,8 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/arcnmx/go-git-annex-external/external"
@@ -17,17 +18,42 @@ import (
 )
 
 type B2Ext struct {
-	bucket *backblaze.Bucket
-	prefix string
-	retries int
+	// Shared by every shard.
+	*b2Auth
+	s3 *s3Client
+	// The *openedBucket, which is replaced if it has to be looked up again;
+	// see bucket.
+	openedBucket atomic.Value
+	remoteSettings
 
-	cache struct {
-		filemap     map[string]string
-		enabled     bool
-		incomplete  bool
-		duration    time.Duration
-		timeWritten time.Time
-	}
+	// Every bucket the remote is sharded across, starting with this one, or
+	// nil if it only has the one bucket.
+	shards []*B2Ext
+
+	setupMu sync.Mutex
+	// Whether the bucket was opened from the bucket cache. Guarded by
+	// setupMu.
+	bucketCached bool
+
+	// mu guards everything below, which is shared between the jobs of an
+	// ASYNC session.
+	mu sync.Mutex
+
+	// The file named by the EXPORT request of each job, until the
+	// request that follows it has been handled.
+	exportNames map[*external.External]string
+
+	cache fileCache
+
+	// The file version that each key was stored as, to copy from rather
+	// than uploading the same content again.
+	stored map[string]string
+
+	// The latest answers to CHECKPRESENT.
+	presence map[string]presenceCheck
+
+	// Where the remote keeps files in the repository, once it is known.
+	annexDir string
 
 	lastList struct {
 		setAt time.Time
@@ -37,456 +63,1667 @@ type B2Ext struct {
 	}
 }
 
+// remoteSettings are the settings of the remote that apply to every bucket it
+// is sharded across.
+type remoteSettings struct {
+	prefix string
+	layout string
+	retries int
+	downloadConcurrency int
+	deleteVersions bool
+	headCheck bool
+	skipVerify bool
+	uploadLock bool
+	pinVersions bool
+	compression string
+	appendOnly bool
+	sse sseConfig
+	lock fileLock
+	capWait bool
+	cost int
+	whereisURLDuration time.Duration
+	downloadURL string
+	contentTypeOverride string
+	metadataHeaders bool
+	metadataFields map[string]bool
+	credsStorage string
+	uploadRate *rateLimiter
+	statsFile string
+	downloadRate *rateLimiter
+	bufferSize int
+}
+
+// configSource is where settings and credentials are read from; usually
+// git-annex, or the command line for maintenance commands.
+type configSource interface {
+	GetConfig(name string) (string, error)
+	GetCreds(name string) (string, string, error)
+	SetConfig(name, value string) error
+	SetCreds(name, user, password string) error
+}
+
 type configValues struct {
 	accountID string
 	appKey string
 	keyID string
+	spareKeys []appKey
+	credsCommand string
 	bucketName string
+	buckets string
 	prefix string
 	retryCount string
 	cacheFilenames string
 	cacheFilenamesDuration string
-	canSetCreds bool
+	cacheMaxFiles string
+	downloadConcurrency string
+	deleteMode string
+	checkPresentMode string
+	cost string
+	whereisURLDuration string
+	downloadURL string
+	api string
+	endpoint string
+	proxy string
+	caBundle string
+	tlsMinVersion string
+	timeout string
+	stallTimeout string
+	capWait string
+	bucketID string
+	bucketCache string
+	appendOnly string
+	skipVerify string
+	uploadLock string
+	pinVersions string
+	compression string
+	sse string
+	sseKey string
+	retentionDays string
+	retentionMode string
+	legalHold string
+	lifecycleKeepDays string
+	bucketType string
+	bucketEncryption string
+	bucketInfo string
+	contentType string
+	metadataHeaders string
+	layout string
+	metadataFields string
+	uploadRate string
+	downloadRate string
+	bufferSize string
+	cacheLRU string
+	apiRate string
+	statsFile string
+	logFile string
+	logLevel string
+	embedCreds string
+	encryption string
+	// What to save with saveCreds.
+	saveCreds bool
+	clearKeyConfig bool
+	saveSSEKey bool
+	clearSSEKeyConfig bool
+	saveBucket bool
 }
 
-func authenticate(e *external.External, accountID string, appKey string, keyID string) (*backblaze.B2, error) {
-	b2, err := backblaze.NewB2(backblaze.Credentials{
-		AccountID:      accountID,
-		ApplicationKey: appKey,
-		KeyID:          keyID,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("Couldn't authorize: %v", err)
+// authenticate authorizes with the first of keys that B2 accepts, starting at
+// the one at index first and wrapping around, and returns its index.
+func authenticate(accountID string, keys []appKey, first int) (*backblaze.B2, int, error) {
+	var err error
+	for n := range keys {
+		i := (first + n) % len(keys)
+		key := keys[i]
+		var b2 *backblaze.B2
+		b2, err = authorizeKey(accountID, key)
+		if err == nil {
+			if i > 0 {
+				logs.logf(levelInfo, "authorized with %v", key)
+			}
+			return b2, i, nil
+		}
+		if !isUnauthorized(err) {
+			break
+		}
+		logs.logf(levelInfo, "%v was refused: %v", key, err)
 	}
 
-	return b2, nil
+	return nil, 0, fmt.Errorf("Couldn't authorize: %v", err)
 }
 
-func openBucket(b2 *backblaze.B2, bucketName string, canCreateBucket bool) (*backblaze.Bucket, error) {
-	bucket, err := b2.Bucket(bucketName)
+// openBucket finds the bucket called bucketName or with the ID bucketID, of
+// which at least one must be set, in cached if it is there. If create is set,
+// a missing bucket is created with those settings.
+func (be *B2Ext) openBucket(bucketName, bucketID string, cached *backblaze.BucketInfo, create *bucketSettings) (*backblaze.BucketInfo, error) {
+	bucket, err := be.findBucket(bucketName, bucketID, cached)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't open bucket %#v: %v", bucketName, err)
+		return nil, err
 	}
 
 	if bucket == nil {
-		if !canCreateBucket {
-			return nil, fmt.Errorf("bucket %#v does not exist anymore", bucketName)
+		if create == nil || bucketName == "" || bucketID != "" {
+			return nil, fmt.Errorf("bucket %#v does not exist anymore", bucketName+bucketID)
 		}
 
-		fmt.Fprintf(os.Stderr, "Creating private B2 bucket %#v\n", bucketName)
+		fmt.Fprintf(os.Stderr, "Creating %v B2 bucket %#v\n", create.describe(), bucketName)
 
-		bucket, err = b2.CreateBucket(bucketName, backblaze.AllPrivate)
+		err = be.createBucket(bucketName, create)
 		if err != nil {
 			return nil, fmt.Errorf("couldn't create bucket %#v: %v", bucketName, err)
 		}
+
+		bucket, err = be.findBucket(bucketName, bucketID, nil)
+		if err != nil {
+			return nil, err
+		}
+		if bucket == nil {
+			return nil, fmt.Errorf("bucket %#v was created but can't be found", bucketName)
+		}
 	}
 
-	return bucket, err
+	return bucket, nil
 }
 
-func getConfig(e *external.External) (config configValues, err error) {
-	config = configValues{}
+func (be *B2Ext) findBucket(bucketName, bucketID string, cached *backblaze.BucketInfo) (*backblaze.BucketInfo, error) {
+	// A bucket known from the bucket cache is opened without asking B2.
+	if cached != nil {
+		return cached, nil
+	}
 
-	bucketCred := ""
-	hasBucketCred := false
-	config.accountID, err = os.Getenv("B2_ACCOUNT_ID"), nil
-	if config.accountID == "" {
-		config.accountID, err = e.GetConfig("accountid")
+	api, err := be.api()
+	if err != nil {
+		return nil, err
 	}
-	if config.accountID == "" && err == nil {
-		config.accountID, bucketCred, err = e.GetCreds("b2_account")
-		hasBucketCred = true
+
+	// Only the bucket is listed, which go-backblaze has no way of asking
+	// for. Keys that are restricted to a bucket aren't allowed to list any
+	// others.
+	request := &listBucketsRequest{
+		AccountID:  api.accountID,
+		BucketID:   bucketID,
+		BucketName: bucketName,
 	}
+	response := &listBucketsResponse{}
+	err = be.call("b2_list_buckets", request, response)
 	if err != nil {
-		return
-	}
-	if config.accountID == "" {
-		err = errors.New("You must set B2_ACCOUNT_ID to the backblaze account id")
-		return
+		return nil, fmt.Errorf("couldn't open bucket %#v: %v", bucketName+bucketID, err)
 	}
 
-	config.keyID, config.appKey = os.Getenv("B2_KEY_ID"), os.Getenv("B2_APP_KEY")
-
-	if config.appKey == "" {
-		config.appKey, err = e.GetConfig("appkey")
-		if err == nil {
-			config.keyID, err = e.GetConfig("appkeyid")
+	for _, info := range response.Buckets {
+		if (bucketName == "" || info.Name == bucketName) && (bucketID == "" || info.ID == bucketID) {
+			return info, nil
 		}
-	} else {
-		config.canSetCreds = true
 	}
-	if config.appKey == "" && err == nil {
-		config.keyID, config.appKey, err = e.GetCreds("b2_appkey")
+	return nil, nil
+}
+
+func getConfig(e configSource) (config configValues, err error) {
+	config = configValues{}
+
+	err = getCreds(e, &config)
+	if err != nil {
+		return
 	}
+
+	// Both are handled by git-annex itself, which decides where the creds
+	// are kept from them.
+	config.embedCreds, err = e.GetConfig("embedcreds")
 	if err != nil {
 		return
 	}
-	if config.appKey == "" {
-		err = errors.New("You must set B2_APP_KEY to the backblaze application key")
+	config.encryption, err = e.GetConfig("encryption")
+	if err != nil {
 		return
 	}
 
-	config.bucketName = os.Getenv("B2_BUCKET")
-	if config.bucketName == "" {
-		config.bucketName, err = e.GetConfig("bucket")
-	}
-	if config.bucketName == "" && err == nil {
-		if !hasBucketCred {
-			_, bucketCred, err = e.GetCreds("b2_account")
-		}
-		if err == nil {
-			config.bucketName = bucketCred
-		}
+	config.appendOnly = os.Getenv("B2_APPENDONLY")
+	if config.appendOnly == "" {
+		config.appendOnly, err = e.GetConfig("appendonly")
 	}
 	if err != nil {
 		return
 	}
-	if config.bucketName == "" {
-		err = errors.New("You must set bucket to the bucket name")
+
+	config.skipVerify = os.Getenv("B2_SKIP_VERIFY")
+	if config.skipVerify == "" {
+		config.skipVerify, err = e.GetConfig("skip-verify")
+	}
+	if err != nil {
 		return
 	}
 
-	config.prefix, err = e.GetConfig("prefix")
-	// prefix == "" is ok.
-	if config.prefix != "" && !strings.HasSuffix(config.prefix, "/") {
-		config.prefix = config.prefix + "/"
+	config.uploadLock = os.Getenv("B2_UPLOAD_LOCK")
+	if config.uploadLock == "" {
+		config.uploadLock, err = e.GetConfig("upload-lock")
+	}
+	if err != nil {
+		return
 	}
 
-	config.retryCount = os.Getenv("B2_RETRY_COUNT")
-	if config.retryCount == "" {
-		config.retryCount, err = e.GetConfig("retry-count")
+	config.pinVersions = os.Getenv("B2_PIN_VERSIONS")
+	if config.pinVersions == "" {
+		config.pinVersions, err = e.GetConfig("pin-versions")
 	}
 	if err != nil {
 		return
 	}
 
-	config.cacheFilenames = os.Getenv("B2_CACHE_FILENAMES")
-	if config.cacheFilenames == "" {
-		config.cacheFilenames, err = e.GetConfig("cache-filenames")
+	config.compression = os.Getenv("B2_COMPRESSION")
+	if config.compression == "" {
+		config.compression, err = e.GetConfig("compression")
 	}
 	if err != nil {
 		return
 	}
 
-	config.cacheFilenamesDuration = os.Getenv("B2_CACHE_FILENAMES_DURATION")
-	if config.cacheFilenamesDuration == "" {
-		config.cacheFilenamesDuration, err = e.GetConfig("cache-filenames-duration")
+	config.sse = os.Getenv("B2_SSE")
+	if config.sse == "" {
+		config.sse, err = e.GetConfig("sse")
 	}
 	if err != nil {
 		return
 	}
 
-	return
-}
-
-func (be *B2Ext) initFileMap() (err error) {
-	be.cache.filemap = make(map[string]string)
-	nextfile := ""
-	for i := 0; i < 100; i++ {
-		response, err := be.bucket.ListFileNames(nextfile, 10000)
-		if err != nil {
-			return err
-		}
-		for _, file := range response.Files {
-			be.cache.filemap[file.Name] = file.ID
-		}
-		nextfile = response.NextFileName
-		if nextfile == "" {
-			break
-		}
+	config.retentionDays = os.Getenv("B2_RETENTION_DAYS")
+	if config.retentionDays == "" {
+		config.retentionDays, err = e.GetConfig("retention-days")
 	}
-	be.cache.timeWritten = time.Now()
-	if nextfile != "" {
-		be.cache.incomplete = true
+	if err != nil {
+		return
 	}
-	return nil
-}
-
-func (be *B2Ext) listFileCached(file string) (found bool, fileID string, err error) {
-	if be.cache.enabled {
-		if be.cache.filemap == nil || be.cache.duration != 0 && time.Since(be.cache.timeWritten) > be.cache.duration {
-			err = be.initFileMap()
-			if err != nil {
-				be.cache.filemap = nil
-				return false, "", err
-			}
-		}
 
-		if be.cache.filemap[file] != "" {
-			return true, be.cache.filemap[file], nil
-		}
-		if !be.cache.incomplete {
-			return false, "", nil
-		}
+	config.retentionMode = os.Getenv("B2_RETENTION_MODE")
+	if config.retentionMode == "" {
+		config.retentionMode, err = e.GetConfig("retention-mode")
 	}
-
-	// Caching the last result of ListFileNames is no less safe than not caching
-	// it; the race condition of two concurrent git annex copy --to b2 processes
-	// sending the same file can result in a file with two identical versions in
-	// both cases.
-	//
-	// However, caching this reduces the number of ListFileNames to half of what
-	// it is during uploads (since git-annex always calls checkpresent which
-	// uses ListFileNames before uploading, but when uploading we also do
-	// upload elision by calling ListFileNames.)
-
-	if be.lastList.file != file || time.Since(be.lastList.setAt) > time.Second*15 {
-		res, err := be.bucket.ListFileNames(file, 1)
-		if err != nil {
-			return false, "", err
-		}
-
-		be.lastList.setAt = time.Now()
-		if len(res.Files) == 0 || res.Files[0].Name != file || res.Files[0].Action != backblaze.Upload {
-			be.lastList.file = file
-			be.lastList.found = false
-			be.lastList.id = ""
-		} else {
-			be.lastList.file = file
-			be.lastList.found = true
-			be.lastList.id = res.Files[0].ID
-		}
+	if err != nil {
+		return
 	}
 
-	return be.lastList.found, be.lastList.id, nil
-}
-
-func (be *B2Ext) clearListFileCache() {
-	be.lastList.setAt = time.Time{}
-	be.lastList.file = ""
-	be.lastList.found = false
-	be.lastList.id = ""
-}
-
-func (be *B2Ext) setup(e *external.External, canCreateBucket bool) error {
-	if be.bucket != nil {
-		// already done!
-		return nil
+	config.legalHold = os.Getenv("B2_LEGAL_HOLD")
+	if config.legalHold == "" {
+		config.legalHold, err = e.GetConfig("legal-hold")
 	}
-
-	config, err := getConfig(e)
 	if err != nil {
-		return err
+		return
 	}
 
-	s := config.retryCount
-	if s == "" {
-		be.retries = 1
-	} else {
-		n, err := strconv.Atoi(s)
-		if err != nil {
-			return err
-		} else {
-			be.retries = n
-		}
+	config.lifecycleKeepDays = os.Getenv("B2_LIFECYCLE_KEEP_PRIOR_VERSIONS_DAYS")
+	if config.lifecycleKeepDays == "" {
+		config.lifecycleKeepDays, err = e.GetConfig("lifecycle-keep-prior-versions-days")
 	}
-
-	s = config.cacheFilenames
-	if s == "" {
-		be.cache.enabled = false
-	} else {
-		be.cache.enabled, err = strconv.ParseBool(s)
-		if err != nil {
-			return err
-		}
+	if err != nil {
+		return
 	}
 
-	s = config.cacheFilenamesDuration
-	if s == "" {
-		be.cache.duration = time.Duration(0)
-	} else {
-		n, err := strconv.Atoi(s)
-		if err == nil {
-			be.cache.duration = time.Duration(n) * time.Second
-		} else {
-			be.cache.duration, err = time.ParseDuration(s)
-			if err != nil {
-				return err
-			}
-		}
+	config.bucketType = os.Getenv("B2_BUCKET_TYPE")
+	if config.bucketType == "" {
+		config.bucketType, err = e.GetConfig("bucket-type")
 	}
-	if be.cache.duration < 0 {
-		return errors.New("cache duration must be non-negative")
+	if err != nil {
+		return
 	}
 
-	b2, err := authenticate(e, config.accountID, config.appKey, config.keyID)
+	config.bucketEncryption = os.Getenv("B2_BUCKET_ENCRYPTION")
+	if config.bucketEncryption == "" {
+		config.bucketEncryption, err = e.GetConfig("bucket-encryption")
+	}
 	if err != nil {
-		return err
+		return
 	}
 
-	bucket, err := openBucket(b2, config.bucketName, canCreateBucket)
+	config.bucketInfo = os.Getenv("B2_BUCKET_INFO")
+	if config.bucketInfo == "" {
+		config.bucketInfo, err = e.GetConfig("bucket-info")
+	}
 	if err != nil {
-		return err
+		return
 	}
 
-	be.bucket = bucket
-	be.prefix = config.prefix
-
-	if config.canSetCreds && canCreateBucket {
-		err = e.SetCreds("b2_account", config.accountID, config.bucketName)
-		if err != nil {
-			return err
-		}
-
-		err = e.SetCreds("b2_appkey", config.keyID, config.appKey)
-		if err != nil {
-			return err
-		}
+	config.contentType = os.Getenv("B2_CONTENT_TYPE")
+	if config.contentType == "" {
+		config.contentType, err = e.GetConfig("content-type")
 	}
-
-	return nil
-}
-
-func (be *B2Ext) InitRemote(e *external.External) error {
-	return be.setup(e, true)
-}
-
-func (be *B2Ext) Prepare(e *external.External) error {
-	return be.setup(e, false)
-}
-
-func (be *B2Ext) Store(e *external.External, key, file string) error {
-	fh, err := os.Open(file)
 	if err != nil {
-		return err
+		return
 	}
-	defer fh.Close()
-
-	shaReady := make(chan struct{})
-	var haveSHA []byte
-	var contentLength int64
-	var shaError error
-	go func() {
-		defer close(shaReady)
-
-		sha := sha1.New()
-		contentLength, shaError = io.Copy(sha, fh)
-		if shaError != nil {
-			return
-		}
-
-		haveSHA = sha.Sum(nil)
-
-		_, shaError = fh.Seek(0, 0)
-	}()
 
-	found, fileID, err := be.listFileCached(be.prefix + key)
+	config.metadataHeaders = os.Getenv("B2_METADATA_HEADERS")
+	if config.metadataHeaders == "" {
+		config.metadataHeaders, err = e.GetConfig("metadata-headers")
+	}
 	if err != nil {
-		return fmt.Errorf("couldn't list filenames: %v", err)
+		return
 	}
 
-	if found {
-		// file probably already stored; make sure using the SHA1
-		b2file, err := be.bucket.GetFileInfo(fileID)
-		if err != nil {
-			return fmt.Errorf("couldn't get file info for %#v: %v", fileID, err)
-		}
-		if b2file != nil {
-			<-shaReady
-
-			wantSHA, err := hex.DecodeString(b2file.ContentSha1)
-			if err == nil && bytes.Equal(haveSHA, wantSHA) {
-				// File already exists with correct data.
-				return nil
-			}
-		}
+	config.metadataFields = os.Getenv("B2_METADATA_FIELDS")
+	if config.metadataFields == "" {
+		config.metadataFields, err = e.GetConfig("metadata-fields")
 	}
-
-	<-shaReady
-	if shaError != nil {
-		return fmt.Errorf("couldn't hash local file %v: %v", file, shaError)
+	if err != nil {
+		return
 	}
 
-	for i := uint(0); i < uint(be.retries + 1); i++ {
-		b2file, err := be.bucket.UploadHashedFile(
-			be.prefix+key,
-			nil,
-			external.NewProgressReader(fh, e),
-			hex.EncodeToString(haveSHA),
-			contentLength)
-
-		if b2err, ok := err.(*backblaze.B2Error); ok {
-			if b2err.IsFatal() {
-				return fmt.Errorf("couldn't upload file: %v", err)
-			} else {
-				wait := time.Duration(1 << i) * time.Second
-				e.Debug(fmt.Sprintf("upload failed, retrying in %v, error: %v", wait, err))
-
-				_, err = fh.Seek(0, 0)
-				if err != nil {
-					return fmt.Errorf("couldn't retry upload: %v", err)
-				}
-
-				time.Sleep(wait)
-			}
-		} else if err != nil {
-			return fmt.Errorf("couldn't upload file: %v", err)
-		} else {
-			be.clearListFileCache()
-			if be.cache.enabled {
-				be.cache.filemap[b2file.Name] = b2file.ID
-			}
-			break
-		}
+	config.uploadRate = os.Getenv("B2_UPLOAD_RATE")
+	if config.uploadRate == "" {
+		config.uploadRate, err = e.GetConfig("upload-rate")
 	}
-
-	return nil
-}
-
-func (be *B2Ext) Retrieve(e *external.External, key, file string) error {
-	fh, err := os.Create(file)
 	if err != nil {
-		return fmt.Errorf("couldn't open %v for writing: %v", file, err)
+		return
 	}
-	defer fh.Close()
 
-	_, rc, err := be.bucket.DownloadFileByName(be.prefix + key)
-	if rc != nil {
-		defer rc.Close()
+	config.bufferSize = os.Getenv("B2_BUFFER_SIZE")
+	if config.bufferSize == "" {
+		config.bufferSize, err = e.GetConfig("buffer-size")
 	}
 	if err != nil {
-		return err
+		return
 	}
 
-	_, err = io.Copy(fh, external.NewProgressReader(rc, e))
+	config.downloadRate = os.Getenv("B2_DOWNLOAD_RATE")
+	if config.downloadRate == "" {
+		config.downloadRate, err = e.GetConfig("download-rate")
+	}
 	if err != nil {
-		return err
+		return
 	}
 
-	return nil
-}
-
-func (be *B2Ext) CheckPresent(e *external.External, key string) (bool, error) {
-	found, _, err := be.listFileCached(be.prefix + key)
+	config.apiRate = os.Getenv("B2_API_RATE")
+	if config.apiRate == "" {
+		config.apiRate, err = e.GetConfig("api-rate")
+	}
 	if err != nil {
-		return false, fmt.Errorf("couldn't list filenames: %v", err)
+		return
 	}
 
-	return found, nil
-}
-
-func (be *B2Ext) Remove(e *external.External, key string) error {
-	found, _, err := be.listFileCached(be.prefix + key)
+	config.statsFile = os.Getenv("B2_STATS_FILE")
+	if config.statsFile == "" {
+		config.statsFile, err = e.GetConfig("stats-file")
+	}
 	if err != nil {
-		return fmt.Errorf("couldn't list filenames: %v", err)
+		return
 	}
 
-	if !found {
-		// File already non-existent, nothing to remove
-		return nil
+	config.logFile = os.Getenv("B2_LOG_FILE")
+	if config.logFile == "" {
+		config.logFile, err = e.GetConfig("log-file")
+	}
+	if err != nil {
+		return
 	}
 
-	_, err = be.bucket.HideFile(be.prefix + key)
-	be.clearListFileCache()
+	config.logLevel = os.Getenv("B2_LOG_LEVEL")
+	if config.logLevel == "" {
+		config.logLevel, err = e.GetConfig("log-level")
+	}
 	if err != nil {
-		return fmt.Errorf("couldn't delete file version: %v", err)
+		return
 	}
 
+	config.layout = os.Getenv("B2_LAYOUT")
+	if config.layout == "" {
+		config.layout, err = e.GetConfig("layout")
+	}
+	if err != nil {
+		return
+	}
+
+	if config.sse == sseC {
+		// The key is stored like the application key, so that it's only
+		// in the clear when git-annex's encryption is off.
+		config.sseKey = os.Getenv("B2_SSE_KEY")
+		if config.sseKey == "" {
+			config.sseKey, err = e.GetConfig("sse-key")
+			if config.sseKey != "" {
+				config.clearSSEKeyConfig = true
+			}
+		}
+		if config.sseKey != "" {
+			config.saveSSEKey = true
+		}
+		if config.sseKey == "" && err == nil {
+			_, config.sseKey, err = e.GetCreds("b2_ssekey")
+		}
+		if err != nil {
+			return
+		}
+		if config.sseKey == "" {
+			err = errors.New("You must set B2_SSE_KEY to the base64 encoded SSE-C key")
+			return
+		}
+	}
+
+	config.bucketID = os.Getenv("B2_BUCKET_ID")
+	if config.bucketID == "" {
+		config.bucketID, err = e.GetConfig("bucketid")
+	} else {
+		config.saveBucket = true
+	}
+	if err != nil {
+		return
+	}
+
+	config.bucketCache, err = e.GetConfig("bucket-cache")
+	if err != nil {
+		return
+	}
+
+	if config.bucketName == "" && config.bucketID == "" && config.buckets == "" {
+		err = errors.New("You must set bucket to the bucket name")
+		return
+	}
+
+	config.prefix, err = e.GetConfig("prefix")
+	// prefix == "" is ok.
+	if config.prefix != "" && !strings.HasSuffix(config.prefix, "/") {
+		config.prefix = config.prefix + "/"
+	}
+
+	config.retryCount = os.Getenv("B2_RETRY_COUNT")
+	if config.retryCount == "" {
+		config.retryCount, err = e.GetConfig("retry-count")
+	}
+	if err != nil {
+		return
+	}
+
+	config.cacheFilenames = os.Getenv("B2_CACHE_FILENAMES")
+	if config.cacheFilenames == "" {
+		config.cacheFilenames, err = e.GetConfig("cache-filenames")
+	}
+	if err != nil {
+		return
+	}
+
+	config.cacheFilenamesDuration = os.Getenv("B2_CACHE_FILENAMES_DURATION")
+	if config.cacheFilenamesDuration == "" {
+		config.cacheFilenamesDuration, err = e.GetConfig("cache-filenames-duration")
+	}
+	if err != nil {
+		return
+	}
+
+	config.cacheLRU = os.Getenv("B2_CACHE_LRU")
+	if config.cacheLRU == "" {
+		config.cacheLRU, err = e.GetConfig("cache-lru")
+	}
+	if err != nil {
+		return
+	}
+
+	config.cacheMaxFiles = os.Getenv("B2_CACHE_MAX_FILES")
+	if config.cacheMaxFiles == "" {
+		config.cacheMaxFiles, err = e.GetConfig("cache-max-files")
+	}
+	if err != nil {
+		return
+	}
+
+	config.downloadConcurrency = os.Getenv("B2_DOWNLOAD_CONCURRENCY")
+	if config.downloadConcurrency == "" {
+		config.downloadConcurrency, err = e.GetConfig("download-concurrency")
+	}
+	if err != nil {
+		return
+	}
+
+	config.deleteMode = os.Getenv("B2_DELETE_MODE")
+	if config.deleteMode == "" {
+		config.deleteMode, err = e.GetConfig("delete-mode")
+	}
+	if err != nil {
+		return
+	}
+
+	config.checkPresentMode = os.Getenv("B2_CHECKPRESENT_MODE")
+	if config.checkPresentMode == "" {
+		config.checkPresentMode, err = e.GetConfig("checkpresent-mode")
+	}
+	if err != nil {
+		return
+	}
+
+	config.cost = os.Getenv("B2_COST")
+	if config.cost == "" {
+		config.cost, err = e.GetConfig("cost")
+	}
+	if err != nil {
+		return
+	}
+
+	config.whereisURLDuration = os.Getenv("B2_WHEREIS_URL_DURATION")
+	if config.whereisURLDuration == "" {
+		config.whereisURLDuration, err = e.GetConfig("whereis-url-duration")
+	}
+	if err != nil {
+		return
+	}
+
+	config.downloadURL = os.Getenv("B2_DOWNLOAD_URL")
+	if config.downloadURL == "" {
+		config.downloadURL, err = e.GetConfig("download-url")
+	}
+	if err != nil {
+		return
+	}
+
+	config.api = os.Getenv("B2_API")
+	if config.api == "" {
+		config.api, err = e.GetConfig("api")
+	}
+	if err != nil {
+		return
+	}
+
+	config.endpoint = os.Getenv("B2_ENDPOINT")
+	if config.endpoint == "" {
+		config.endpoint, err = e.GetConfig("endpoint")
+	}
+	if err != nil {
+		return
+	}
+
+	config.proxy = os.Getenv("B2_PROXY")
+	if config.proxy == "" {
+		config.proxy, err = e.GetConfig("proxy")
+	}
+	if err != nil {
+		return
+	}
+
+	config.caBundle = os.Getenv("B2_CA_BUNDLE")
+	if config.caBundle == "" {
+		config.caBundle, err = e.GetConfig("ca-bundle")
+	}
+	if err != nil {
+		return
+	}
+
+	config.tlsMinVersion = os.Getenv("B2_TLS_MIN_VERSION")
+	if config.tlsMinVersion == "" {
+		config.tlsMinVersion, err = e.GetConfig("tls-min-version")
+	}
+	if err != nil {
+		return
+	}
+
+	config.timeout = os.Getenv("B2_TIMEOUT")
+	if config.timeout == "" {
+		config.timeout, err = e.GetConfig("timeout")
+	}
+	if err != nil {
+		return
+	}
+
+	config.stallTimeout = os.Getenv("B2_STALL_TIMEOUT")
+	if config.stallTimeout == "" {
+		config.stallTimeout, err = e.GetConfig("stall-timeout")
+	}
+	if err != nil {
+		return
+	}
+
+	config.capWait = os.Getenv("B2_CAP_WAIT")
+	if config.capWait == "" {
+		config.capWait, err = e.GetConfig("cap-wait")
+	}
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (be *B2Ext) listFileCached(file string) (found bool, fileID string, err error) {
+	// The cache only covers the names that keys are stored under, not the
+	// directories of an exported tree.
+	if be.cache.enabled && be.isKeyName(file) {
+		be.mu.Lock()
+		known, found, fileID := be.cache.lookup(file)
+		full := be.cache.full()
+		be.mu.Unlock()
+
+		if known {
+			return found, fileID, nil
+		}
+		// Once the cache is full, names it doesn't cover are looked up
+		// individually below.
+		if !full {
+			return be.fillCache(file)
+		}
+		notices.add(fmt.Sprintf("the filename cache is full at %v names, so names outside of it are listed one at a time; raise cache-max-files or pass cache-lru=true", be.cache.maxFiles))
+	}
+
+	// Caching the last result of ListFileNames is no less safe than not caching
+	// it; the race condition of two concurrent git annex copy --to b2 processes
+	// sending the same file can result in a file with two identical versions in
+	// both cases. upload-lock closes that race between the processes of
+	// one repository.
+	//
+	// However, caching this reduces the number of ListFileNames to half of what
+	// it is during uploads (since git-annex always calls checkpresent which
+	// uses ListFileNames before uploading, but when uploading we also do
+	// upload elision by calling ListFileNames.)
+
+	be.mu.Lock()
+	if be.lastList.file == file && time.Since(be.lastList.setAt) <= time.Second*15 {
+		defer be.mu.Unlock()
+		return be.lastList.found, be.lastList.id, nil
+	}
+	be.mu.Unlock()
+
+	found, fileID, err = be.listFile(file)
+	if err != nil {
+		return false, "", err
+	}
+
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	be.lastList.setAt = time.Now()
+	be.lastList.file = file
+	be.lastList.found = found
+	be.lastList.id = fileID
+
+	return be.lastList.found, be.lastList.id, nil
+}
+
+// listFile looks file up in the bucket, bypassing the caches.
+func (be *B2Ext) listFile(file string) (found bool, fileID string, err error) {
+	if be.headCheck {
+		return be.headFile(file)
+	}
+
+	var res *backblaze.ListFilesResponse
+	err = be.withBucket(func() (err error) {
+		res, err = be.bucket().ListFileNamesWithPrefix(file, 1, file, "")
+		return err
+	})
+	if err != nil {
+		return false, "", err
+	}
+	if len(res.Files) == 0 || res.Files[0].Name != file || res.Files[0].Action != backblaze.Upload {
+		return false, "", nil
+	}
+	return true, res.Files[0].ID, nil
+}
+
+// clearListFileCache must be called with mu held.
+func (be *B2Ext) clearListFileCache() {
+	be.lastList.setAt = time.Time{}
+	be.lastList.file = ""
+	be.lastList.found = false
+	be.lastList.id = ""
+}
+
+// fileStored updates the cached listings after name was uploaded.
+func (be *B2Ext) fileStored(name, fileID string) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	be.clearListFileCache()
+	if be.cache.enabled {
+		be.cache.add(name, fileID)
+	}
+}
+
+// fileRemoved updates the cached listings after name was hidden or deleted.
+func (be *B2Ext) fileRemoved(name string) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	be.clearListFileCache()
+	be.cache.remove(name)
+}
+
+func (be *B2Ext) setup(e configSource, canCreateBucket bool) error {
+	be.setupMu.Lock()
+	defer be.setupMu.Unlock()
+
+	if be.bucket() != nil {
+		// already done!
+		return nil
+	}
+
+	config, err := getConfig(e)
+	if err != nil {
+		return err
+	}
+
+	names, err := parseBuckets(config.buckets)
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		if config.bucketID != "" {
+			return errors.New("bucketid can't be used with buckets")
+		}
+		// The first bucket is the one remembered in the creds.
+		config.bucketName = names[0]
+	}
+
+	err = be.configure(e, config, canCreateBucket)
+	if err != nil {
+		return err
+	}
+
+	if canCreateBucket {
+		err = saveCreds(e, config, be.bucket().Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = be.setupShards(config, names, canCreateBucket)
+	if err != nil {
+		return err
+	}
+
+	if canCreateBucket {
+		return be.saveBucketCache(e)
+	}
+	return nil
+}
+
+// parseDuration parses a setting given either in seconds or as a Go duration
+// such as "1m30s". An empty setting gives def.
+func parseDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+
+	var d time.Duration
+	n, err := strconv.Atoi(s)
+	if err == nil {
+		d = time.Duration(n) * time.Second
+	} else {
+		d, err = time.ParseDuration(s)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if d < 0 {
+		return 0, errors.New("duration must be non-negative")
+	}
+	return d, nil
+}
+
+// configure applies config to be, authorizes and opens its bucket.
+func (be *B2Ext) configure(e configSource, config configValues, canCreateBucket bool) error {
+	var err error
+	s := config.retryCount
+	if s == "" {
+		be.retries = 1
+	} else {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		} else {
+			be.retries = n
+		}
+	}
+
+	s = config.cacheFilenames
+	if s == "" {
+		be.cache.enabled = false
+	} else {
+		be.cache.enabled, err = strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	be.cache.duration, err = parseDuration(config.cacheFilenamesDuration, 0)
+	if err != nil {
+		return fmt.Errorf("couldn't parse cache duration: %v", err)
+	}
+
+	s = config.cacheMaxFiles
+	if s == "" {
+		be.cache.maxFiles = 0
+	} else {
+		be.cache.maxFiles, err = strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		if be.cache.maxFiles < 0 {
+			return errors.New("cache max files must be non-negative")
+		}
+	}
+
+	s = config.cacheLRU
+	if s == "" {
+		be.cache.lru = false
+	} else {
+		be.cache.lru, err = strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	s = config.downloadConcurrency
+	if s == "" {
+		be.downloadConcurrency = 1
+	} else {
+		be.downloadConcurrency, err = strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		if be.downloadConcurrency < 1 {
+			return errors.New("download concurrency must be at least 1")
+		}
+	}
+
+	switch config.deleteMode {
+	case "", "hide":
+		be.deleteVersions = false
+	case "delete":
+		be.deleteVersions = true
+	default:
+		return fmt.Errorf("unknown delete mode %#v, expected hide or delete", config.deleteMode)
+	}
+
+	switch config.checkPresentMode {
+	case "", "list":
+		be.headCheck = false
+	case "head":
+		be.headCheck = true
+	default:
+		return fmt.Errorf("unknown checkpresent mode %#v, expected list or head", config.checkPresentMode)
+	}
+
+	s = config.appendOnly
+	if s == "" {
+		be.appendOnly = false
+	} else {
+		be.appendOnly, err = strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+	}
+	if be.appendOnly && be.deleteVersions {
+		return errors.New("delete-mode=delete can't be used with appendonly")
+	}
+
+	s = config.skipVerify
+	if s == "" {
+		be.skipVerify = false
+	} else {
+		be.skipVerify, err = strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	s = config.uploadLock
+	if s == "" {
+		be.uploadLock = false
+	} else {
+		be.uploadLock, err = strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	s = config.pinVersions
+	if s == "" {
+		be.pinVersions = false
+	} else {
+		be.pinVersions, err = strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	be.compression, err = parseCompression(config.compression)
+	if err != nil {
+		return err
+	}
+
+	be.sse, err = parseSSE(config.sse, config.sseKey)
+	if err != nil {
+		return err
+	}
+
+	if config.contentType != "" && !strings.Contains(config.contentType, "/") {
+		return fmt.Errorf("content type %#v must be a MIME type such as text/plain", config.contentType)
+	}
+	be.contentTypeOverride = config.contentType
+
+	s = config.metadataHeaders
+	if s == "" {
+		be.metadataHeaders = false
+	} else {
+		be.metadataHeaders, err = strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+	}
+	be.metadataFields = nil
+	if config.metadataFields != "" {
+		be.metadataFields = make(map[string]bool)
+		for _, field := range strings.Split(config.metadataFields, ",") {
+			be.metadataFields[strings.TrimSpace(field)] = true
+		}
+	}
+
+	rate, err := parseRate(config.uploadRate)
+	if err != nil {
+		return fmt.Errorf("couldn't parse upload rate: %v", err)
+	}
+	be.uploadRate = newRateLimiter(float64(rate))
+	rate, err = parseRate(config.downloadRate)
+	if err != nil {
+		return fmt.Errorf("couldn't parse download rate: %v", err)
+	}
+	be.downloadRate = newRateLimiter(float64(rate))
+
+	size, err := parseSize(config.bufferSize, "buffer size")
+	if err != nil {
+		return err
+	}
+	be.bufferSize = int(size)
+
+	switch config.layout {
+	case "", layoutFlat:
+		be.layout = layoutFlat
+	case layoutHashDir:
+		be.layout = layoutHashDir
+	default:
+		return fmt.Errorf("unknown layout %#v, expected flat or hashdir", config.layout)
+	}
+
+	be.statsFile = config.statsFile
+
+	logs.secret(config.appKey)
+	for _, key := range config.spareKeys {
+		logs.secret(key.appKey)
+	}
+	logs.secret(config.sseKey)
+	if config.logFile != "" {
+		level, err := parseLogLevel(config.logLevel)
+		if err != nil {
+			return err
+		}
+		err = logs.open(config.logFile, level)
+		if err != nil {
+			return fmt.Errorf("couldn't open log file: %v", err)
+		}
+	}
+
+	be.lock, err = parseFileLock(config.retentionDays, config.retentionMode, config.legalHold)
+	if err != nil {
+		return err
+	}
+
+	s = config.cost
+	if s == "" {
+		be.cost = expensiveRemoteCost
+	} else {
+		be.cost, err = strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	s = config.capWait
+	if s == "" {
+		be.capWait = false
+	} else {
+		be.capWait, err = strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	be.whereisURLDuration, err = parseDuration(config.whereisURLDuration, 0)
+	if err != nil {
+		return err
+	}
+	if be.whereisURLDuration > maxDownloadAuthorizationDuration {
+		return fmt.Errorf("whereis URL duration must be between 0 and %v", maxDownloadAuthorizationDuration)
+	}
+
+	be.downloadURL = strings.TrimSuffix(config.downloadURL, "/")
+	if be.downloadURL != "" && !strings.HasPrefix(be.downloadURL, "https://") && !strings.HasPrefix(be.downloadURL, "http://") {
+		return fmt.Errorf("download URL %#v must be an http or https URL", config.downloadURL)
+	}
+
+	switch config.api {
+	case "", "native", "s3":
+	default:
+		return fmt.Errorf("unknown API %#v, expected native or s3", config.api)
+	}
+
+	err = installTransport(config)
+	if err != nil {
+		return err
+	}
+
+	keys := append([]appKey{{keyID: config.keyID, appKey: config.appKey}}, config.spareKeys...)
+	indexFile, err := be.keyIndexFile(e)
+	if err != nil {
+		return err
+	}
+	first := 0
+	if !canCreateBucket {
+		first = loadKeyIndex(indexFile, len(keys))
+	}
+	b2, index, err := authenticate(config.accountID, keys, first)
+	if err != nil {
+		return err
+	}
+	if index != first {
+		saveKeyIndex(indexFile, index)
+	}
+
+	be.b2Auth = &b2Auth{
+		b2:          b2,
+		appKeys:     keys,
+		appKeyIndex: index,
+		indexFile:   indexFile,
+	}
+	be.prefix = config.prefix
+	be.credsStorage = credsStorage(config.embedCreds, config.encryption)
+
+	return be.configureBucket(config, canCreateBucket)
+}
+
+// configureBucket opens the bucket of config, once be has been authorized.
+func (be *B2Ext) configureBucket(config configValues, canCreateBucket bool) error {
+	// Application keys can be restricted to a bucket, and to names within it
+	// that start with a prefix.
+	api, err := be.api()
+	if err != nil {
+		return err
+	}
+
+	// Preparing the remote opens the bucket from the cache, so long as the
+	// key still has access to it.
+	var cached *backblaze.BucketInfo
+	if !canCreateBucket {
+		cached, err = cachedBucket(config.bucketCache, api.accountID, config.bucketName, config.bucketID)
+		if err != nil {
+			return err
+		}
+		if cached != nil && api.allowed.BucketID != "" && api.allowed.BucketID != cached.ID {
+			cached = nil
+		}
+	}
+
+	err = api.allowed.check(&config, cached == nil)
+	if err != nil {
+		return err
+	}
+
+	var create *bucketSettings
+	if canCreateBucket && api.allowed.can("writeBuckets") {
+		create, err = parseBucketSettings(config.bucketType, config.bucketEncryption, config.bucketInfo)
+		if err != nil {
+			return err
+		}
+		create.lifecycle, err = parseLifecycle(config.lifecycleKeepDays, config.prefix)
+		if err != nil {
+			return err
+		}
+	}
+
+	bucket, err := be.openBucket(config.bucketName, config.bucketID, cached, create)
+	if err != nil {
+		return err
+	}
+
+	if config.api == "s3" {
+		be.s3, err = newS3Client(api.s3URL, bucket.Name, be.client().Credentials, be.sse, be.lock)
+		if err != nil {
+			return err
+		}
+		be.addS3Client(be.s3)
+	}
+
+	be.setBucket(bucket)
+	// An ID that was set explicitly isn't looked up again.
+	be.bucketCached = cached != nil && config.bucketID == ""
+
+	return nil
+}
+
+func (be *B2Ext) InitRemote(e *external.External) error {
+	return be.setup(e, true)
+}
+
+func (be *B2Ext) Prepare(e *external.External) error {
+	defer notices.flush(e)
+	return be.setup(e, false)
+}
+
+func (be *B2Ext) Store(e *external.External, key, file string) error {
+	defer transactions.debug(e)
+	defer notices.flush(e)
+	shard := be.shardFor(key)
+	fileID, err := shard.storeFile(e, shard.keyName(key), key, file)
+	if err != nil {
+		return err
+	}
+	return be.pinVersion(e, key, fileID)
+}
+
+// storeFile uploads file as name, unless it is already there, and returns
+// the ID of the stored version. The content is that of key.
+func (be *B2Ext) storeFile(e *external.External, name, key, file string) (string, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	stat, err := fh.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	// Without a SHA1 up front, the upload computes it as it goes.
+	var haveSHA []byte
+	if sha, size, ok := keySHA1(key); ok && (size < 0 || size == stat.Size()) {
+		haveSHA = sha
+	}
+
+	// Everything other than keys is stored by its name in an exported tree.
+	export := name != be.keyName(key)
+
+	// Exported files aren't compressed, so that they can still be read
+	// straight out of the bucket.
+	codec := be.compression
+	if export {
+		codec = ""
+	}
+
+	waited := false
+	if be.uploadLock {
+		var unlock func()
+		unlock, waited, err = be.lockUpload(e, name)
+		if err != nil {
+			return "", fmt.Errorf("couldn't lock %v for uploading: %v", name, err)
+		}
+		defer unlock()
+	}
+
+	var found bool
+	var fileID string
+	if waited {
+		// Another process was uploading it, and what was known before
+		// is out of date.
+		found, fileID, err = be.listFile(name)
+		if err == nil && found {
+			be.fileStored(name, fileID)
+		}
+	} else if export || !be.knownAbsent(key) {
+		found, fileID, err = be.listFileCached(name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("couldn't list filenames: %v", err)
+	}
+
+	if found && be.skipVerify && !export {
+		// Whatever is stored under the key's name is taken to be its
+		// content. Exported files change under the same name, so they are
+		// always checked. It isn't recorded as a copy source, since its
+		// content was never checked.
+		stats.elision()
+		return fileID, nil
+	}
+
+	if found {
+		// file probably already stored; make sure using the SHA1
+		b2file, err := be.bucket().GetFileInfo(fileID)
+		if err != nil {
+			return "", fmt.Errorf("couldn't get file info for %#v: %v", fileID, err)
+		}
+		if b2file != nil {
+			if haveSHA == nil {
+				haveSHA, err = hashFile(fh)
+				if err != nil {
+					return "", fmt.Errorf("couldn't hash local file %v: %v", file, err)
+				}
+			}
+
+			wantSHA, err := hex.DecodeString(storedSHA1(b2file))
+			if err == nil && bytes.Equal(haveSHA, wantSHA) {
+				// File already exists with correct data.
+				if fileInfoValue(b2file, compressionInfo) == "" {
+					be.keyStored(key, fileID)
+				}
+				stats.elision()
+				return fileID, nil
+			}
+		}
+	}
+
+	var sourceID string
+	// Copying goes through b2_copy_file, which only needs the ID of the
+	// source, so with the S3 API the content is uploaded again instead.
+	if codec == "" && be.s3 == nil {
+		sourceID, haveSHA, err = be.copySource(e, key, name, fh, haveSHA)
+		if err != nil {
+			return "", fmt.Errorf("couldn't hash local file %v: %v", file, err)
+		}
+	}
+	if sourceID != "" {
+		// The same content is already in the bucket under another name, so
+		// there's no need to send it again.
+		b2file, err := be.copyFile(e, sourceID, name, key, export)
+		if err == nil {
+			be.keyStored(key, b2file.ID)
+			be.forgetPresence(key)
+			stats.copy()
+			return b2file.ID, nil
+		}
+		e.Debug(fmt.Sprintf("couldn't copy %v, uploading it instead: %v", key, err))
+	}
+
+	body := fh
+	size := stat.Size()
+	var extraInfo map[string]string
+	if codec != "" {
+		compressed, sha, err := be.compressFile(e, fh, codec)
+		if err != nil {
+			return "", fmt.Errorf("couldn't compress %v: %v", file, err)
+		}
+		defer os.Remove(compressed.Name())
+		defer compressed.Close()
+
+		stat, err := compressed.Stat()
+		if err != nil {
+			return "", err
+		}
+		body = compressed
+		size = stat.Size()
+		extraInfo = compressedInfo(codec, sha)
+		// The key's SHA1 is of the content before it was compressed.
+		haveSHA = nil
+	}
+
+	if size > maxUploadSize {
+		return "", fmt.Errorf("%v is over the %v bytes that can be uploaded at once, chunk= is needed", file, maxUploadSize)
+	}
+
+	// B2 checks uploads through the S3 API against a SHA1 that has to be
+	// sent before the content is.
+	if be.s3 != nil && haveSHA == nil {
+		_, err = body.Seek(0, io.SeekStart)
+		if err == nil {
+			haveSHA, err = hashFile(body)
+		}
+		if err != nil {
+			return "", fmt.Errorf("couldn't hash local file %v: %v", file, err)
+		}
+	}
+
+	contentType := be.contentType(name, export)
+	info := be.fileInfo(e, name, key, export, extraInfo)
+
+	var b2file *backblaze.File
+	err = be.retry(e, "upload", func() error {
+		_, err := body.Seek(0, 0)
+		if err != nil {
+			return fmt.Errorf("couldn't rewind %v: %v", file, err)
+		}
+
+		if be.s3 != nil {
+			b2file, err = be.s3.putObject(name, contentType, info, limitReader(external.NewProgressReader(body, e), be.uploadRate), size, haveSHA)
+			return err
+		}
+
+		b2file, err = be.uploadFile(
+			name,
+			contentType,
+			info,
+			limitReader(external.NewProgressReader(body, e), be.uploadRate),
+			size,
+			haveSHA)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("couldn't upload file: %v", err)
+	}
+
+	be.fileStored(b2file.Name, b2file.ID)
+	if codec == "" {
+		be.keyStored(key, b2file.ID)
+	}
+	be.forgetPresence(key)
+	stats.addUploaded(size)
+
+	return b2file.ID, nil
+}
+
+func (be *B2Ext) Retrieve(e *external.External, key, file string) error {
+	defer transactions.debug(e)
+	defer notices.flush(e)
+	shard, name, fileID, _, err := be.findKey(e, key)
+	if err != nil {
+		return err
+	}
+	return shard.retrieveFile(e, name, fileID, file)
+}
+
+// retrieveFile downloads name into file. If fileID is set, that version of
+// name is downloaded rather than the current one.
+func (be *B2Ext) retrieveFile(e *external.External, name, fileID, file string) error {
+	// git-annex hands us the same temporary file when retrying a transfer, so
+	// don't truncate it; any data already there is resumed from below.
+	fh, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return fmt.Errorf("couldn't open %v for writing: %v", file, err)
+	}
+	defer fh.Close()
+
+	if fileID == "" && be.appendOnly {
+		// The file may have been hidden, in which case it can only be
+		// downloaded by ID.
+		fileID, err = be.newestUpload(name)
+		if err != nil {
+			return err
+		}
+		if fileID == "" {
+			return fmt.Errorf("%v does not exist", name)
+		}
+	}
+
+	verifier := newDownloadVerifier()
+	var b2file *backblaze.File
+	err = be.retry(e, "download", func() (err error) {
+		b2file, err = be.download(e, fh, name, fileID, verifier)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = verifier.verify(fh, b2file)
+	if err == nil {
+		err = be.decompressFile(fh, file, b2file)
+	}
+	if err != nil {
+		os.Remove(file)
+		return err
+	}
+
+	return nil
+}
+
+// download makes a single attempt at fetching name into fh, continuing from
+// wherever a previous attempt left off, and returns the version downloaded.
+func (be *B2Ext) download(e *external.External, fh *os.File, name, fileID string, verifier *downloadVerifier) (*backblaze.File, error) {
+	offset, err := fh.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	var b2file *backblaze.File
+	if fileID != "" {
+		b2file, err = be.bucket().GetFileInfo(fileID)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get file info for %#v: %v", fileID, err)
+		}
+	} else if offset > 0 || be.downloadConcurrency > 1 {
+		b2file, err = be.lookupFile(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	offset, err = resumeOffset(fh, offset, b2file)
+	if err != nil {
+		return nil, err
+	}
+
+	if b2file != nil && be.downloadConcurrency > 1 && b2file.ContentLength-offset >= 2*minDownloadPartSize {
+		return b2file, be.downloadParallel(e, fh, b2file, offset)
+	}
+
+	// Whatever is already in the file has to be hashed before the rest of it
+	// can be streamed through the verifier.
+	err = verifier.catchUp(fh, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	var fileRange *backblaze.FileRange
+	if offset > 0 {
+		e.Debug(fmt.Sprintf("resuming download of %v at byte %v", name, offset))
+		fileRange = &backblaze.FileRange{
+			Start: offset,
+			End:   b2file.ContentLength - 1,
+		}
+	}
+
+	var rc io.ReadCloser
+	var dlfile *backblaze.File
+	switch {
+	case be.downloadURL != "" && fileID == "":
+		dlfile, rc, err = be.downloadByName(name, fileRange)
+	case be.s3 != nil:
+		dlfile, rc, err = be.s3.getObject(name, fileID, fileRange)
+	case be.ownDownloads() && fileID != "":
+		dlfile, rc, err = be.downloadByID(fileID, fileRange)
+	case be.ownDownloads():
+		dlfile, rc, err = be.downloadByName(name, fileRange)
+	case fileID != "":
+		dlfile, rc, err = be.client().DownloadFileRangeByID(fileID, fileRange)
+	case fileRange != nil:
+		dlfile, rc, err = be.bucket().DownloadFileRangeByName(name, fileRange)
+	default:
+		dlfile, rc, err = be.bucket().DownloadFileByName(name)
+	}
+	if rc != nil {
+		defer rc.Close()
+	}
+	if err != nil {
+		return nil, transient(err)
+	}
+	if b2file == nil {
+		b2file = dlfile
+	}
+
+	_, err = be.copyContents(io.MultiWriter(fh, verifier), newProgressReader(limitReader(countingReader{transientReader{rc}}, be.downloadRate), e, offset))
+	if err != nil {
+		return nil, err
+	}
+
+	return b2file, nil
+}
+
+// lookupFile returns the current version of name, or nil if it doesn't exist.
+func (be *B2Ext) lookupFile(name string) (*backblaze.File, error) {
+	found, fileID, err := be.listFileCached(name)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list filenames: %v", err)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	b2file, err := be.bucket().GetFileInfo(fileID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get file info for %#v: %v", fileID, err)
+	}
+
+	return b2file, nil
+}
+
+// resumeOffset decides whether the offset bytes left in fh from a previous
+// attempt at downloading b2file can be kept, and returns the offset the
+// download should continue from. Partial files that can't be resumed are
+// truncated.
+func resumeOffset(fh *os.File, offset int64, b2file *backblaze.File) (int64, error) {
+	if offset == 0 {
+		return 0, nil
+	}
+
+	// An offset equal to the size is a complete download that wasn't
+	// reported as such; fetch it again rather than asking for an empty range.
+	if b2file != nil && offset < b2file.ContentLength {
+		return offset, nil
+	}
+
+	if err := fh.Truncate(0); err != nil {
+		return 0, err
+	}
+	return fh.Seek(0, io.SeekStart)
+}
+
+func (be *B2Ext) CheckPresent(e *external.External, key string) (bool, error) {
+	defer transactions.debug(e)
+	defer notices.flush(e)
+	shard, name, _, found, err := be.findKey(e, key)
+	if err == nil && shard == be.shardFor(key) && name == shard.keyName(key) {
+		shard.presenceChecked(key, found)
+	}
+	return found, err
+}
+
+func (be *B2Ext) checkPresent(name string) (bool, error) {
+	var found bool
+	var err error
+	if be.s3 != nil {
+		found, err = be.s3.headObject(name)
+		if err != nil {
+			return false, fmt.Errorf("couldn't check for %v: %v", name, err)
+		}
+	} else {
+		found, _, err = be.listFileCached(name)
+		if err != nil {
+			return false, fmt.Errorf("couldn't list filenames: %v", err)
+		}
+	}
+
+	if !found && be.appendOnly {
+		// Content that was hidden by something else is still there.
+		fileID, err := be.newestUpload(name)
+		if err != nil {
+			return false, err
+		}
+		found = fileID != ""
+	}
+
+	return found, nil
+}
+
+// newestUpload returns the ID of the newest version of name, whether or not
+// it has since been hidden, or "" if there is none.
+func (be *B2Ext) newestUpload(name string) (string, error) {
+	versions, err := be.listVersions(name)
+	if err != nil {
+		return "", err
+	}
+
+	for _, file := range versions {
+		if file.Action == backblaze.Upload {
+			return file.ID, nil
+		}
+	}
+	return "", nil
+}
+
+func (be *B2Ext) Remove(e *external.External, key string) error {
+	defer transactions.debug(e)
+	defer notices.flush(e)
+	err := be.removeKey(key)
+	if err != nil {
+		return err
+	}
+	err = be.pinVersion(e, key, "")
+	if err != nil {
+		return err
+	}
+
+	// Files that were added by URL aren't ours to remove, so just forget
+	// about them the way the web remote does.
+	urls, err := be.claimedURLs(e, key)
+	if err != nil {
+		return err
+	}
+	for _, url := range urls {
+		err = e.SetURLMissing(key, url)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (be *B2Ext) removeFile(name string) error {
+	if be.appendOnly {
+		return fmt.Errorf("refusing to remove %v from an appendonly remote", name)
+	}
+
+	if be.deleteVersions {
+		// Hidden versions don't show up as present, but still need deleting.
+		err := be.deleteAllVersions(name)
+		be.fileRemoved(name)
+		return err
+	}
+
+	found, _, err := be.listFileCached(name)
+	if err != nil {
+		return fmt.Errorf("couldn't list filenames: %v", err)
+	}
+
+	if !found {
+		// File already non-existent, nothing to remove
+		return nil
+	}
+
+	if be.s3 != nil {
+		err = be.s3.deleteObject(name)
+	} else {
+		_, err = be.bucket().HideFile(name)
+	}
+	be.fileRemoved(name)
+	if err != nil {
+		return fmt.Errorf("couldn't delete file version: %v", err)
+	}
+
+	return nil
+}
+
+// deleteAllVersions permanently deletes every version of name, including hide
+// markers, unless any of them is retained.
+func (be *B2Ext) deleteAllVersions(name string) error {
+	versions, err := be.listVersions(name)
+	if err != nil {
+		return err
+	}
+	err = checkRetained(name, versions)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range versions {
+		err = be.deleteVersion(file.Name, file.ID)
+		if err != nil {
+			return fmt.Errorf("couldn't delete file version %#v: %v", file.ID, err)
+		}
+	}
 	return nil
 }
 
+// deleteVersion permanently deletes the version fileID of name.
+func (be *B2Ext) deleteVersion(name, fileID string) error {
+	if be.s3 != nil {
+		return be.s3.deleteObjectVersion(name, fileID)
+	}
+	_, err := be.bucket().DeleteFileVersion(name, fileID)
+	return err
+}
+
+// The cost git-annex gives to remotes that aren't on the local machine.
+const expensiveRemoteCost = 200
+
 func (be *B2Ext) GetCost(e *external.External) (int, error) {
-	return 0, external.ErrUnsupportedRequest
+	return be.cost, nil
 }
 
 func (be *B2Ext) GetAvailability(e *external.External) (external.Availability, error) {
@@ -494,9 +1731,28 @@ func (be *B2Ext) GetAvailability(e *external.External) (external.Availability, e
 }
 
 func (be *B2Ext) WhereIs(e *external.External, key string) (string, error) {
-	if be.bucket.BucketType == backblaze.AllPublic {
+	if len(be.shards) > 1 {
+		shard, err := be.storedShard(key)
+		if err != nil {
+			return "", err
+		}
+		if shard == nil {
+			return "", nil
+		}
+		return shard.whereIs(key)
+	}
+	return be.whereIs(key)
+}
+
+func (be *B2Ext) whereIs(key string) (string, error) {
+	if be.bucket().BucketType == backblaze.AllPublic {
 		// this generally shouldn't touch the network but might if auth is invalidated :(
-		return be.bucket.FileURL(be.prefix + key)
+		return be.fileURL(be.keyName(key))
+	} else if be.sse.mode == sseC {
+		// Nobody without the key can download the file anyway.
+		return "", nil
+	} else if be.whereisURLDuration > 0 {
+		return be.signedURL(be.keyName(key), be.whereisURLDuration)
 	} else {
 		return "", nil
 	}
@@ -508,13 +1764,45 @@ func (be *B2Ext) ListConfigs(e *external.External) ([]external.Config, error) {
 			Name: "bucket",
 			Description: "B2 bucket name where files are placed (or B2_BUCKET environment variable)",
 		},
+		external.Config {
+			Name: "buckets",
+			Description: "Comma separated B2 bucket names to shard keys across instead of bucket (or B2_BUCKETS environment variable)",
+		},
+		external.Config {
+			Name: "accountid",
+			Description: "B2 account ID, only needed with the master application key, which is stored in the git-annex creds (or B2_ACCOUNT_ID environment variable)",
+		},
+		external.Config {
+			Name: "appkeyid",
+			Description: "B2 application key ID, when not using the master application key, which is stored in the git-annex creds (or B2_KEY_ID environment variable)",
+		},
+		external.Config {
+			Name: "appkey",
+			Description: "B2 application key, which is moved into the git-annex creds (or B2_APP_KEY environment variable)",
+		},
+		external.Config {
+			Name: "creds-command",
+			Description: "Shell command that prints the B2 application key on its first line and optionally keyid: followed by the key ID on another, run instead of storing them (or B2_CREDS_COMMAND environment variable)",
+		},
+		external.Config {
+			Name: "appkey-2",
+			Description: "Spare B2 application key to fail over to, followed by appkey-3 and so on, with appkeyid-2 and so on; moved into the git-annex creds like appkey (or B2_APP_KEY_2 and B2_KEY_ID_2 environment variables)",
+		},
+		external.Config {
+			Name: "bucketid",
+			Description: "ID of the bucket to use, in place of or as well as its name (or B2_BUCKET_ID environment variable)",
+		},
+		external.Config {
+			Name: "bucket-cache",
+			Description: "The ID and type of each bucket, saved by initremote and enableremote so that the buckets don't have to be listed again",
+		},
 		external.Config {
 			Name: "prefix",
 			Description: "Object key prefix used when naming files in the bucket. A slash is appended in order to simulate a directory name.",
 		},
 		external.Config {
 			Name: "retry-count",
-			Description: "Amount of times to retry an upload (or B2_RETRY_COUNT environment variable)",
+			Description: "Amount of times to retry a transfer (or B2_RETRY_COUNT environment variable)",
 		},
 		external.Config {
 			Name: "cache-filenames",
@@ -524,52 +1812,395 @@ func (be *B2Ext) ListConfigs(e *external.External) ([]external.Config, error) {
 			Name: "cache-filenames-duration",
 			Description: "Amount of seconds to consider the cache valid for, defaults to 0 and never expires (or B2_CACHE_FILENAMES_DURATION environment variable)",
 		},
+		external.Config {
+			Name: "cache-max-files",
+			Description: "Maximum number of filenames to hold in the cache, defaults to 0 for no limit (or B2_CACHE_MAX_FILES environment variable)",
+		},
+		external.Config {
+			Name: "cache-lru",
+			Description: "Whether to drop the least recently used filenames once the cache holds cache-max-files of them, rather than to stop adding to it; defaults to false (or B2_CACHE_LRU environment variable)",
+		},
+		external.Config {
+			Name: "delete-mode",
+			Description: "Set to delete to permanently delete every version of a removed key instead of hiding it, defaults to hide (or B2_DELETE_MODE environment variable)",
+		},
+		external.Config {
+			Name: "checkpresent-mode",
+			Description: "Set to head to look files up with a HEAD request for their download, a class B transaction, instead of listing them, which is class C; defaults to list (or B2_CHECKPRESENT_MODE environment variable)",
+		},
+		external.Config {
+			Name: "cost",
+			Description: "Cost used by git-annex to choose between remotes, defaults to 200 (or B2_COST environment variable)",
+		},
+		external.Config {
+			Name: "whereis-url-duration",
+			Description: "How long the download URLs shown by whereis stay valid for in private buckets, up to a week; defaults to 0 and shows none (or B2_WHEREIS_URL_DURATION environment variable)",
+		},
+		external.Config {
+			Name: "download-url",
+			Description: "URL of a CDN or other host in front of the bucket to download files and show whereis URLs from, in place of the B2 download host (or B2_DOWNLOAD_URL environment variable)",
+		},
+		external.Config {
+			Name: "api",
+			Description: "API to transfer files with, native or s3; defaults to native (or B2_API environment variable)",
+		},
+		external.Config {
+			Name: "endpoint",
+			Description: "URL of a B2 API emulator or proxy to use instead of api.backblazeb2.com (or B2_ENDPOINT environment variable)",
+		},
+		external.Config {
+			Name: "proxy",
+			Description: "URL of an HTTP proxy to connect through, defaults to the HTTPS_PROXY and HTTP_PROXY environment variables (or B2_PROXY environment variable)",
+		},
+		external.Config {
+			Name: "ca-bundle",
+			Description: "PEM file of extra CA certificates to trust, such as a corporate proxy's (or B2_CA_BUNDLE environment variable)",
+		},
+		external.Config {
+			Name: "tls-min-version",
+			Description: "Oldest TLS version to connect with, 1.2 or 1.3; defaults to 1.2 (or B2_TLS_MIN_VERSION environment variable)",
+		},
+		external.Config {
+			Name: "timeout",
+			Description: "Seconds to wait for a connection or a reply before giving up and retrying, defaults to 60; 0 waits forever (or B2_TIMEOUT environment variable)",
+		},
+		external.Config {
+			Name: "stall-timeout",
+			Description: "Seconds a transfer can go without any data moving before giving up and retrying, defaults to 60; 0 waits forever (or B2_STALL_TIMEOUT environment variable)",
+		},
+		external.Config {
+			Name: "cap-wait",
+			Description: "Whether transfers that hit the account's daily caps wait for them to reset at midnight GMT instead of failing, defaults to false (or B2_CAP_WAIT environment variable)",
+		},
+		external.Config {
+			Name: "appendonly",
+			Description: "Whether to refuse to remove anything, and find content that something else hid; defaults to false (or B2_APPENDONLY environment variable)",
+		},
+		external.Config {
+			Name: "upload-lock",
+			Description: "Whether to take a lock in the repository while uploading each key, so that concurrent git-annex processes don't both upload it; defaults to false (or B2_UPLOAD_LOCK environment variable)",
+		},
+		external.Config {
+			Name: "skip-verify",
+			Description: "Whether to trust that a file already stored under a key's name has its content, rather than comparing SHA1s before skipping the upload; defaults to false (or B2_SKIP_VERIFY environment variable)",
+		},
+		external.Config {
+			Name: "pin-versions",
+			Description: "Whether to record the file version each key is stored as in the git-annex branch, and check for and retrieve that version by ID; defaults to false (or B2_PIN_VERSIONS environment variable)",
+		},
+		external.Config {
+			Name: "compression",
+			Description: "How to compress keys before uploading them, none, gzip or zstd; defaults to none (or B2_COMPRESSION environment variable)",
+		},
+		external.Config {
+			Name: "sse",
+			Description: "Server-side encryption to ask B2 for when uploading, none, b2 or c to use a key of your own; defaults to none (or B2_SSE environment variable)",
+		},
+		external.Config {
+			Name: "sse-key",
+			Description: "Base64 encoded 256-bit key for sse=c, which is moved into the git-annex creds (or B2_SSE_KEY environment variable)",
+		},
+		external.Config {
+			Name: "content-type",
+			Description: "Content-Type to upload everything with, such as b2/x-auto to have B2 guess; defaults to application/octet-stream for keys and one from the extension for exported files (or B2_CONTENT_TYPE environment variable)",
+		},
+		external.Config {
+			Name: "metadata-headers",
+			Description: "Whether to store git-annex metadata, and the names of exported files, as B2 file info; defaults to false (or B2_METADATA_HEADERS environment variable)",
+		},
+		external.Config {
+			Name: "metadata-fields",
+			Description: "Comma separated git-annex metadata fields to store with metadata-headers; defaults to all of them (or B2_METADATA_FIELDS environment variable)",
+		},
+		external.Config {
+			Name: "layout",
+			Description: "How keys are laid out under the prefix, flat or hashdir for two levels of directories like a directory special remote; defaults to flat and can't be changed later (or B2_LAYOUT environment variable)",
+		},
+		external.Config {
+			Name: "retention-days",
+			Description: "Days that B2 Object Lock keeps each uploaded file from being deleted, in a bucket with Object Lock enabled; defaults to 0 (or B2_RETENTION_DAYS environment variable)",
+		},
+		external.Config {
+			Name: "retention-mode",
+			Description: "Object Lock retention mode, governance or compliance; defaults to governance (or B2_RETENTION_MODE environment variable)",
+		},
+		external.Config {
+			Name: "legal-hold",
+			Description: "Whether to place an Object Lock legal hold on each uploaded file, on or off; defaults to off (or B2_LEGAL_HOLD environment variable)",
+		},
+		external.Config {
+			Name: "bucket-type",
+			Description: "Whether a bucket created by initremote is private or public; defaults to private (or B2_BUCKET_TYPE environment variable)",
+		},
+		external.Config {
+			Name: "bucket-encryption",
+			Description: "Default encryption of a bucket created by initremote, none or b2; defaults to none (or B2_BUCKET_ENCRYPTION environment variable)",
+		},
+		external.Config {
+			Name: "bucket-info",
+			Description: "Bucket info of a bucket created by initremote, as key=value pairs separated by commas (or B2_BUCKET_INFO environment variable)",
+		},
+		external.Config {
+			Name: "lifecycle-keep-prior-versions-days",
+			Description: "Days that a bucket created by initremote keeps hidden and superseded versions under the prefix before deleting them (or B2_LIFECYCLE_KEEP_PRIOR_VERSIONS_DAYS environment variable)",
+		},
+		external.Config {
+			Name: "upload-rate",
+			Description: "Maximum rate to upload at across all transfers, such as 5MiB or 500k per second; defaults to unlimited (or B2_UPLOAD_RATE environment variable)",
+		},
+		external.Config {
+			Name: "download-rate",
+			Description: "Maximum rate to download at across all transfers, such as 5MiB or 500k per second; defaults to unlimited (or B2_DOWNLOAD_RATE environment variable)",
+		},
+		external.Config {
+			Name: "buffer-size",
+			Description: "Size of the buffers that file contents are copied through, such as 16k or 1MiB; defaults to Go's own (or B2_BUFFER_SIZE environment variable)",
+		},
+		external.Config {
+			Name: "api-rate",
+			Description: "Maximum number of class B and C API calls, which B2 charges for past a daily allowance, to make per second; defaults to unlimited (or B2_API_RATE environment variable)",
+		},
+		external.Config {
+			Name: "log-file",
+			Description: "File to append a timestamped log to, with credentials left out (or B2_LOG_FILE environment variable)",
+		},
+		external.Config {
+			Name: "log-level",
+			Description: "How much to log, one of error, info, debug or protocol for every line of the protocol; defaults to debug (or B2_LOG_LEVEL environment variable)",
+		},
+		external.Config {
+			Name: "stats-file",
+			Description: "File to append the transfer and API call statistics of each session to as a line of JSON (or B2_STATS_FILE environment variable)",
+		},
+		external.Config {
+			Name: "download-concurrency",
+			Description: "Number of ranged requests used to download large files in parallel, defaults to 1 (or B2_DOWNLOAD_CONCURRENCY environment variable)",
+		},
 	}
 
 	return res, nil
 }
 
-func (be *B2Ext) ClaimUrl(e *external.External, url string) (bool, error) {
-	// TODO: support this?
-	return false, external.ErrUnsupportedRequest
-}
+func (be *B2Ext) GetInfo(e *external.External) ([]external.Info, error) {
+	deleteMode := "hide"
+	if be.deleteVersions {
+		deleteMode = "delete"
+	}
+	checkPresentMode := "list"
+	if be.headCheck {
+		checkPresentMode = "head"
+	}
+	compression := be.compression
+	if compression == "" {
+		compression = "none"
+	}
+	apiName := "native"
+	if be.s3 != nil {
+		apiName = "s3"
+	}
+	legalHold := "off"
+	if be.lock.legalHold {
+		legalHold = "on"
+	}
 
-func (be *B2Ext) CheckUrl(e *external.External, url string) ([]external.CheckUrl, error) {
-	// TODO: support this?
-	return nil, external.ErrUnsupportedRequest
-}
+	partSize := "unknown"
+	if api, err := be.api(); err == nil && api.partSize > 0 {
+		partSize = fmt.Sprintf("%v bytes", api.partSize)
+	}
+
+	be.authMu.Lock()
+	appKey := fmt.Sprintf("%v (%v of %v)", be.appKeys[be.appKeyIndex], be.appKeyIndex+1, len(be.appKeys))
+	be.authMu.Unlock()
 
-func (be *B2Ext) GetInfo(e *external.External) ([]external.Info, error) {
 	res := []external.Info {
 		external.Info {
 			Name: "account-id",
-			Value: be.bucket.AccountID,
+			Value: be.bucket().AccountID,
+		},
+		external.Info {
+			Name: "app key",
+			Value: appKey,
 		},
 		external.Info {
 			Name: "bucket",
-			Value: be.bucket.Name,
+			Value: be.bucket().Name,
 		},
 		external.Info {
 			Name: "bucket-id",
-			Value: be.bucket.ID,
+			Value: be.bucket().ID,
+		},
+		external.Info {
+			Name: "creds",
+			Value: be.credsStorage,
+		},
+		external.Info {
+			Name: "buckets",
+			Value: be.bucketNames(),
+		},
+		external.Info {
+			Name: "bucket-type",
+			Value: string(be.bucket().BucketType),
 		},
 		external.Info {
 			Name: "prefix",
 			Value: be.prefix,
 		},
+		external.Info {
+			Name: "filename cache",
+			Value: be.cacheStatus(),
+		},
+		external.Info {
+			Name: "retry-count",
+			Value: strconv.Itoa(be.retries),
+		},
+		external.Info {
+			Name: "download-url",
+			Value: be.downloadURL,
+		},
+		external.Info {
+			Name: "api",
+			Value: apiName,
+		},
+		external.Info {
+			Name: "download-concurrency",
+			Value: strconv.Itoa(be.downloadConcurrency),
+		},
+		external.Info {
+			Name: "delete-mode",
+			Value: deleteMode,
+		},
+		external.Info {
+			Name: "checkpresent-mode",
+			Value: checkPresentMode,
+		},
+		external.Info {
+			Name: "sse",
+			Value: be.sse.String(),
+		},
+		external.Info {
+			Name: "retention",
+			Value: be.lock.String(),
+		},
+		external.Info {
+			Name: "legal-hold",
+			Value: legalHold,
+		},
+		external.Info {
+			Name: "transactions",
+			Value: transactions.String(),
+		},
+		external.Info {
+			Name: "api calls",
+			Value: transactions.callsString(),
+		},
+		external.Info {
+			Name: "session",
+			Value: stats.String(),
+		},
+		external.Info {
+			Name: "appendonly",
+			Value: strconv.FormatBool(be.appendOnly),
+		},
+		external.Info {
+			Name: "upload-lock",
+			Value: strconv.FormatBool(be.uploadLock),
+		},
+		external.Info {
+			Name: "skip-verify",
+			Value: strconv.FormatBool(be.skipVerify),
+		},
+		external.Info {
+			Name: "pin-versions",
+			Value: strconv.FormatBool(be.pinVersions),
+		},
+		external.Info {
+			Name: "compression",
+			Value: compression,
+		},
+		external.Info {
+			// Every key is sent with a single upload.
+			Name: "large file uploads",
+			Value: fmt.Sprintf("no, files over %v bytes need chunk=", maxUploadSize),
+		},
+		external.Info {
+			Name: "recommended part size",
+			Value: partSize,
+		},
 	}
 	return res, nil
 }
 
+func (be *B2Ext) cacheStatus() string {
+	if !be.cache.enabled {
+		return "disabled"
+	}
+
+	status := "enabled"
+	if be.cache.duration != 0 {
+		status += fmt.Sprintf(", expires after %v", be.cache.duration)
+	}
+	if be.cache.maxFiles != 0 {
+		status += fmt.Sprintf(", up to %v files", be.cache.maxFiles)
+		if be.cache.lru {
+			status += ", dropping the least recently used"
+		}
+	}
+
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	return status + fmt.Sprintf(", %v files cached", len(be.cache.filemap))
+}
+
 func (be *B2Ext) Extensions(e *external.External, extensions []string) ([]string, error) {
-	return nil, external.ErrUnsupportedRequest
+	supported := []string{}
+	for _, extension := range extensions {
+		switch extension {
+		case "ASYNC":
+			// Handled by runLoop, which routes each job to its own External.
+			supported = append(supported, extension)
+		case "INFO":
+			// Used for notices; see noticeBoard.
+			supported = append(supported, extension)
+		}
+	}
+	return supported, nil
 }
 
 func (be *B2Ext) Unhandled(e *external.External, request string, fields string) error {
+	defer notices.flush(e)
+	switch request {
+	case "EXPORTSUPPORTED", "EXPORT", "TRANSFEREXPORT", "CHECKPRESENTEXPORT",
+		"REMOVEEXPORT", "REMOVEEXPORTDIRECTORY", "RENAMEEXPORT":
+		return be.handleExport(e, request, fields)
+	case "IMPORTSUPPORTED", "LISTIMPORTABLECONTENTS", "RETRIEVEEXPORTEXPECTED",
+		"STOREEXPORTEXPECTED", "REMOVEEXPORTEXPECTED", "REMOVEEXPORTDIRECTORYWHENEMPTY":
+		return be.handleImport(e, request, fields)
+	}
+
 	return external.ErrUnsupportedRequest
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		var run func([]string) error
+		switch os.Args[1] {
+		case "gc":
+			run = runGC
+		case "legal-hold":
+			run = runLegalHold
+		case "lifecycle":
+			run = runLifecycle
+		}
+		if run != nil {
+			err := run(os.Args[2:])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+	}
+
 	h := &B2Ext{}
 
 	var (
@@ -577,17 +2208,34 @@ func main() {
 		out io.Writer = os.Stdout
 	)
 
+	// Logging starts here when it's set up in the environment, so that the
+	// protocol leading up to PREPARE is logged too.
+	logs.secret(os.Getenv("B2_APP_KEY"))
+	logs.secret(os.Getenv("B2_SSE_KEY"))
 	if os.Getenv("GIT_ANNEX_EXTERNAL_B2_PROTOCOL_DEBUG") != "" {
 		fmt.Fprintf(os.Stderr, "git-annex-remote-b2: enabling protocol debug logging\n")
-		in = io.TeeReader(in, os.Stderr)
-		out = io.MultiWriter(out, os.Stderr)
+		logs.open("-", levelProtocol)
+	}
+	if path := os.Getenv("B2_LOG_FILE"); path != "" {
+		level, err := parseLogLevel(os.Getenv("B2_LOG_LEVEL"))
+		if err == nil {
+			err = logs.open(path, level)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "git-annex-remote-b2: couldn't open log file: %v\n", err)
+		}
 	}
+	in = io.TeeReader(in, &protocolLog{})
+	out = io.MultiWriter(out, &protocolLog{fromRemote: true})
+
+	handleSignals(h)
 
-	err := external.RunLoop(in, out, h)
+	err := runLoop(in, out, h)
 	if err != nil {
+		logs.logf(levelError, "%v", err)
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		exit(h, 1)
 	}
 
-	os.Exit(0)
+	exit(h, 0)
 }
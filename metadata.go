@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/arcnmx/go-git-annex-external/external"
+)
+
+// B2 allows at most 10 file info entries per file.
+const maxFileInfo = 10
+
+// fileInfo returns the file info that name is uploaded with: extra, which is
+// needed to read it back, and when metadata-headers is set, the file name for
+// exported files and the chosen git-annex metadata fields of key. The rest is
+// only there to make the bucket easier to browse, so failing to find the
+// metadata doesn't fail the upload.
+func (be *B2Ext) fileInfo(e *external.External, name, key string, export bool, extra map[string]string) map[string]string {
+	if !be.metadataHeaders {
+		return extra
+	}
+
+	info := make(map[string]string)
+	for k, v := range extra {
+		info[k] = v
+	}
+	if export {
+		info["filename"] = path.Base(name)
+	}
+
+	fields, err := annexMetadata(e, key)
+	if err != nil {
+		e.Debug(fmt.Sprintf("couldn't get the metadata of %v: %v", key, err))
+	}
+
+	var names []string
+	for field := range fields {
+		if be.metadataFields != nil && !be.metadataFields[field] {
+			continue
+		}
+		// git-annex keeps track of when each field changed in fields of
+		// its own, which say nothing about the file.
+		if be.metadataFields == nil && strings.HasSuffix(field, "lastchanged") {
+			continue
+		}
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	for _, field := range names {
+		if len(info) == maxFileInfo {
+			e.Debug(fmt.Sprintf("only storing the first %v metadata fields of %v", maxFileInfo, key))
+			break
+		}
+		info["annex-"+fileInfoName(field)] = strings.Join(fields[field], ",")
+	}
+
+	return info
+}
+
+// annexMetadata asks git-annex for the metadata of key, which the protocol
+// has no request for.
+func annexMetadata(e *external.External, key string) (map[string][]string, error) {
+	gitDir, err := e.GetGitDir()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("git", "annex", "metadata", "--json", "--key="+key)
+	cmd.Env = append(os.Environ(), "GIT_DIR="+gitDir)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	result := struct {
+		Fields map[string][]string `json:"fields"`
+	}{}
+	err = json.Unmarshal(out, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result.Fields, nil
+}
+
+// fileInfoName turns a metadata field into a name that B2 accepts for file
+// info, which is limited to lower case letters, digits, "-" and "_".
+func fileInfoName(field string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', '0' <= r && r <= '9', r == '-', r == '_':
+			return r
+		case 'A' <= r && r <= 'Z':
+			return r + 'a' - 'A'
+		default:
+			return '_'
+		}
+	}, field)
+}
+
+// setFileInfoHeaders adds info to an upload as headers starting with prefix,
+// which is "X-Bz-Info-" for the native API and "X-Amz-Meta-" for S3.
+func setFileInfoHeaders(h http.Header, prefix string, info map[string]string) {
+	for name, value := range info {
+		h.Set(prefix+name, url.QueryEscape(value))
+	}
+}
@@ -0,0 +1,1112 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mockB2 is an in-memory B2 server, with just enough of the native API for
+// the remote to authorize, manage its bucket and transfer files. Both API
+// versions are served from the same handlers, since go-backblaze uses v1 and
+// the rest of the remote v2.
+type mockB2 struct {
+	server    *httptest.Server
+	accountID string
+
+	mu sync.Mutex
+	// Application keys by key ID, including the master application key
+	// under the account ID.
+	keys map[string]string
+	// The name of the bucket that each restricted key is limited to, by key
+	// ID.
+	restricted map[string]string
+	// The key ID that each token was handed out for.
+	tokens  map[string]string
+	buckets map[string]*mockBucket
+	seq     int
+	calls   map[string]int
+	// Status codes to fail the next calls of each API with.
+	failures map[string][]int
+	// How long uploads take to be answered.
+	uploadDelay time.Duration
+}
+
+type mockBucket struct {
+	id         string
+	name       string
+	bucketType string
+	versions   []*mockVersion
+}
+
+type mockVersion struct {
+	seq         int
+	id          string
+	name        string
+	action      string
+	contentType string
+	info        map[string]string
+	data        []byte
+	uploaded    int64
+	// The SHA1 that B2 has for the content, once the content no longer
+	// matches it; see corrupt.
+	sha string
+	// The Object Lock retention mode and when it ends, in milliseconds.
+	retentionMode string
+	retainUntil   int64
+}
+
+const (
+	mockAccountID = "0123456789ab"
+	mockAppKey    = "K000masterkey"
+)
+
+func newMockB2() *mockB2 {
+	m := &mockB2{
+		accountID:  mockAccountID,
+		keys:       map[string]string{mockAccountID: mockAppKey},
+		restricted: make(map[string]string),
+		tokens:     make(map[string]string),
+		buckets:    make(map[string]*mockBucket),
+		calls:      make(map[string]int),
+		failures:   make(map[string][]int),
+	}
+	m.server = httptest.NewServer(m)
+	return m
+}
+
+func (m *mockB2) close() {
+	m.server.Close()
+}
+
+// addKey creates an application key.
+func (m *mockB2) addKey(keyID, appKey string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[keyID] = appKey
+}
+
+// restrictKey creates an application key that only has access to the bucket
+// called bucketName.
+func (m *mockB2) restrictKey(keyID, appKey, bucketName string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[keyID] = appKey
+	m.restricted[keyID] = bucketName
+}
+
+// revokeKey deletes an application key, which also invalidates the tokens
+// made from it.
+func (m *mockB2) revokeKey(keyID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.keys, keyID)
+}
+
+// expireTokens makes every authorization token handed out so far expire.
+func (m *mockB2) expireTokens() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for token := range m.tokens {
+		m.tokens[token] = ""
+	}
+}
+
+// forgetTokens makes every authorization token handed out so far unknown,
+// as if B2 had lost them, without anything being wrong with the keys.
+func (m *mockB2) forgetTokens() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens = make(map[string]string)
+}
+
+// failNext makes the next call of api fail with status, once for each status.
+func (m *mockB2) failNext(api string, status ...int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures[api] = append(m.failures[api], status...)
+}
+
+// count returns how many times api has been called.
+func (m *mockB2) count(api string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls[api]
+}
+
+func (m *mockB2) addBucket(name, bucketType string) *mockBucket {
+	m.seq++
+	b := &mockBucket{
+		id:         fmt.Sprintf("bucket%d", m.seq),
+		name:       name,
+		bucketType: bucketType,
+	}
+	m.buckets[b.id] = b
+	return b
+}
+
+// recreateBucket deletes the bucket called name and creates an empty one in
+// its place, which has a new ID.
+func (m *mockB2) recreateBucket(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, b := range m.buckets {
+		if b.name == name {
+			delete(m.buckets, id)
+			m.addBucket(name, b.bucketType)
+			return
+		}
+	}
+}
+
+// bucket returns the bucket called name, or nil.
+func (m *mockB2) bucket(name string) *mockBucket {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, b := range m.buckets {
+		if b.name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// current returns the newest version of name, or nil if it doesn't exist or
+// is hidden.
+func (b *mockBucket) current(name string) *mockVersion {
+	var newest *mockVersion
+	for _, v := range b.versions {
+		if v.name == name && (newest == nil || v.seq > newest.seq) {
+			newest = v
+		}
+	}
+	if newest == nil || newest.action != "upload" {
+		return nil
+	}
+	return newest
+}
+
+// names returns the names of the files in the bucket that currently exist.
+func (m *mockB2) names(bucket string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for _, b := range m.buckets {
+		if b.name != bucket {
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, v := range b.versions {
+			if !seen[v.name] && b.current(v.name) != nil {
+				seen[v.name] = true
+				names = append(names, v.name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sortedVersions lists the versions of b in the order B2 does: by name, then
+// newest first.
+func (b *mockBucket) sortedVersions() []*mockVersion {
+	versions := append([]*mockVersion(nil), b.versions...)
+	sort.Slice(versions, func(i, j int) bool {
+		if versions[i].name != versions[j].name {
+			return versions[i].name < versions[j].name
+		}
+		return versions[i].seq > versions[j].seq
+	})
+	return versions
+}
+
+func (m *mockB2) addVersion(b *mockBucket, name, action, contentType string, info map[string]string, data []byte) *mockVersion {
+	m.seq++
+	v := &mockVersion{
+		seq:         m.seq,
+		id:          fmt.Sprintf("4_z%s_f%06d", b.id, m.seq),
+		name:        name,
+		action:      action,
+		contentType: contentType,
+		info:        info,
+		data:        data,
+		uploaded:    time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	b.versions = append(b.versions, v)
+	return v
+}
+
+// expireRetention lifts the Object Lock retention of every version.
+func (m *mockB2) expireRetention() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, b := range m.buckets {
+		for _, v := range b.versions {
+			v.retentionMode, v.retainUntil = "", 0
+		}
+	}
+}
+
+// replace uploads data as a new version of name, as something other than the
+// remote would.
+func (m *mockB2) replace(bucket, name string, data []byte) {
+	b := m.bucket(bucket)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addVersion(b, name, "upload", "application/octet-stream", nil, data)
+}
+
+// corrupt changes the content of the current version of name without B2
+// noticing, so that only its SHA1 can tell.
+func (m *mockB2) corrupt(bucket, name string) {
+	b := m.bucket(bucket)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v := b.current(name)
+	v.sha = v.contentSHA1()
+	v.data = append([]byte("corrupted "), v.data...)
+}
+
+// contentSHA1 is the SHA1 that B2 has for the content of v.
+func (v *mockVersion) contentSHA1() string {
+	if v.sha != "" {
+		return v.sha
+	}
+	sum := sha1.Sum(v.data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hide hides name, as something other than the remote would.
+func (m *mockB2) hide(bucket, name string) {
+	b := m.bucket(bucket)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addVersion(b, name, "hide", "", nil, nil)
+}
+
+func (m *mockB2) findVersion(fileID string) (*mockBucket, *mockVersion) {
+	for _, b := range m.buckets {
+		for _, v := range b.versions {
+			if v.id == fileID {
+				return b, v
+			}
+		}
+	}
+	return nil, nil
+}
+
+type mockError struct {
+	status int
+	code   string
+}
+
+// slowUploads makes uploads take d, without holding up anything else.
+func (m *mockB2) slowUploads(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uploadDelay = d
+}
+
+func (m *mockB2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/upload/") {
+		m.mu.Lock()
+		delay := m.uploadDelay
+		m.mu.Unlock()
+		time.Sleep(delay)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r.Host == mockS3Host {
+		m.serveS3(w, r)
+		return
+	}
+
+	var api string
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/b2api/v1/"), strings.HasPrefix(r.URL.Path, "/b2api/v2/"):
+		api = r.URL.Path[len("/b2api/v1/"):]
+	case strings.HasPrefix(r.URL.Path, "/file/"):
+		api = "download"
+	case strings.HasPrefix(r.URL.Path, "/upload/"):
+		api = "upload"
+	}
+	m.calls[api]++
+
+	if failures := m.failures[api]; len(failures) > 0 {
+		m.failures[api] = failures[1:]
+		writeMockError(w, failures[0], "internal_error", "injected failure")
+		return
+	}
+
+	if api == "b2_authorize_account" {
+		m.authorize(w, r)
+		return
+	}
+
+	if api != "download" {
+		if status, code := m.checkToken(r); status != 0 {
+			writeMockError(w, status, code, "not authorized")
+			return
+		}
+	}
+
+	var result interface{}
+	var err *mockError
+	switch api {
+	case "b2_list_buckets":
+		result, err = m.listBuckets(r)
+	case "b2_create_bucket":
+		result, err = m.createBucket(r)
+	case "b2_get_upload_url":
+		result, err = m.getUploadURL(r)
+	case "upload":
+		result, err = m.upload(r)
+	case "b2_list_file_names":
+		result, err = m.listFileNames(r)
+	case "b2_list_file_versions":
+		result, err = m.listFileVersions(r)
+	case "b2_get_file_info":
+		result, err = m.getFileInfo(r)
+	case "b2_hide_file":
+		result, err = m.hideFile(r)
+	case "b2_copy_file":
+		result, err = m.copyFile(r)
+	case "b2_delete_file_version":
+		result, err = m.deleteFileVersion(r)
+	case "b2_download_file_by_id":
+		m.downloadByID(w, r)
+		return
+	case "download":
+		m.downloadByName(w, r)
+		return
+	default:
+		err = &mockError{http.StatusBadRequest, "bad_request"}
+	}
+	if err != nil {
+		writeMockError(w, err.status, err.code, api+" failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func writeMockError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  status,
+		"code":    code,
+		"message": message,
+	})
+}
+
+func (m *mockB2) authorize(w http.ResponseWriter, r *http.Request) {
+	keyID, appKey, ok := r.BasicAuth()
+	if !ok || m.keys[keyID] == "" || m.keys[keyID] != appKey {
+		writeMockError(w, http.StatusUnauthorized, "unauthorized", "bad key")
+		return
+	}
+
+	m.seq++
+	token := fmt.Sprintf("token%d", m.seq)
+	m.tokens[token] = keyID
+
+	allowed := map[string]interface{}{
+		"capabilities": []string{"listBuckets", "writeBuckets", "listFiles", "readFiles", "shareFiles", "writeFiles", "deleteFiles"},
+	}
+	if name, ok := m.restricted[keyID]; ok {
+		allowed["capabilities"] = []string{"listBuckets", "listFiles", "readFiles", "shareFiles", "writeFiles", "deleteFiles"}
+		allowed["bucketName"] = name
+		for _, b := range m.buckets {
+			if b.name == name {
+				allowed["bucketId"] = b.id
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"accountId":           m.accountID,
+		"apiUrl":              m.server.URL,
+		"downloadUrl":         m.server.URL,
+		"s3ApiUrl":            "http://" + mockS3Host,
+		"authorizationToken":  token,
+		"recommendedPartSize": 100000000,
+		"allowed":             allowed,
+	})
+}
+
+// checkToken returns the error status and code for a request whose token
+// isn't valid.
+func (m *mockB2) checkToken(r *http.Request) (int, string) {
+	keyID, ok := m.tokens[r.Header.Get("Authorization")]
+	switch {
+	case !ok:
+		return http.StatusUnauthorized, "bad_auth_token"
+	case keyID == "":
+		return http.StatusUnauthorized, "expired_auth_token"
+	case m.keys[keyID] == "":
+		return http.StatusUnauthorized, "bad_auth_token"
+	}
+	return 0, ""
+}
+
+func decodeMockRequest(r *http.Request, request interface{}) *mockError {
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		return &mockError{http.StatusBadRequest, "bad_request"}
+	}
+	return nil
+}
+
+func (m *mockB2) bucketInfo(b *mockBucket) map[string]interface{} {
+	return map[string]interface{}{
+		"accountId":      m.accountID,
+		"bucketId":       b.id,
+		"bucketName":     b.name,
+		"bucketType":     b.bucketType,
+		"bucketInfo":     map[string]string{},
+		"lifecycleRules": []interface{}{},
+		"revision":       1,
+	}
+}
+
+func (m *mockB2) listBuckets(r *http.Request) (interface{}, *mockError) {
+	request := struct {
+		BucketID   string `json:"bucketId"`
+		BucketName string `json:"bucketName"`
+	}{}
+	if err := decodeMockRequest(r, &request); err != nil {
+		return nil, err
+	}
+
+	// Restricted keys can only list their own bucket, and have to ask for
+	// it.
+	if name, ok := m.restricted[m.tokens[r.Header.Get("Authorization")]]; ok {
+		var allowed bool
+		for _, b := range m.buckets {
+			if b.name == name && (b.id == request.BucketID || b.name == request.BucketName) {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return nil, &mockError{http.StatusUnauthorized, "unauthorized"}
+		}
+	}
+
+	buckets := []interface{}{}
+	for _, b := range m.buckets {
+		if (request.BucketID == "" || b.id == request.BucketID) && (request.BucketName == "" || b.name == request.BucketName) {
+			buckets = append(buckets, m.bucketInfo(b))
+		}
+	}
+	return map[string]interface{}{"buckets": buckets}, nil
+}
+
+func (m *mockB2) createBucket(r *http.Request) (interface{}, *mockError) {
+	request := struct {
+		BucketName string `json:"bucketName"`
+		BucketType string `json:"bucketType"`
+	}{}
+	if err := decodeMockRequest(r, &request); err != nil {
+		return nil, err
+	}
+
+	for _, b := range m.buckets {
+		if b.name == request.BucketName {
+			return nil, &mockError{http.StatusBadRequest, "duplicate_bucket_name"}
+		}
+	}
+	return m.bucketInfo(m.addBucket(request.BucketName, request.BucketType)), nil
+}
+
+func (m *mockB2) getUploadURL(r *http.Request) (interface{}, *mockError) {
+	request := struct {
+		BucketID string `json:"bucketId"`
+	}{}
+	if err := decodeMockRequest(r, &request); err != nil {
+		return nil, err
+	}
+	if m.buckets[request.BucketID] == nil {
+		return nil, &mockError{http.StatusBadRequest, "bad_bucket_id"}
+	}
+
+	return map[string]interface{}{
+		"bucketId":           request.BucketID,
+		"uploadUrl":          m.server.URL + "/upload/" + request.BucketID,
+		"authorizationToken": r.Header.Get("Authorization"),
+	}, nil
+}
+
+func (m *mockB2) upload(r *http.Request) (interface{}, *mockError) {
+	b := m.buckets[strings.TrimPrefix(r.URL.Path, "/upload/")]
+	if b == nil {
+		return nil, &mockError{http.StatusBadRequest, "bad_bucket_id"}
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, &mockError{http.StatusBadRequest, "bad_request"}
+	}
+	sha := r.Header.Get("X-Bz-Content-Sha1")
+	if sha == "hex_digits_at_end" {
+		if len(data) < sha1.Size*2 {
+			return nil, &mockError{http.StatusBadRequest, "bad_request"}
+		}
+		sha = string(data[len(data)-sha1.Size*2:])
+		data = data[:len(data)-sha1.Size*2]
+	}
+	sum := sha1.Sum(data)
+	if sha != hex.EncodeToString(sum[:]) {
+		return nil, &mockError{http.StatusBadRequest, "bad_request"}
+	}
+
+	name, _ := url.QueryUnescape(r.Header.Get("X-Bz-File-Name"))
+	info := make(map[string]string)
+	for k, v := range r.Header {
+		if strings.HasPrefix(k, "X-Bz-Info-") {
+			info[strings.ToLower(strings.TrimPrefix(k, "X-Bz-Info-"))] = v[0]
+		}
+	}
+
+	v := m.addVersion(b, name, "upload", r.Header.Get("Content-Type"), info, data)
+	v.retentionMode = r.Header.Get("X-Bz-File-Retention-Mode")
+	v.retainUntil, _ = strconv.ParseInt(r.Header.Get("X-Bz-File-Retention-Retain-Until-Timestamp"), 10, 64)
+	return m.fileJSON(b, v), nil
+}
+
+func (m *mockB2) fileJSON(b *mockBucket, v *mockVersion) map[string]interface{} {
+	sha := "none"
+	if v.action == "upload" {
+		sha = v.contentSHA1()
+	}
+	info := v.info
+	if info == nil {
+		info = map[string]string{}
+	}
+	var retention interface{}
+	if v.retentionMode != "" {
+		retention = map[string]interface{}{
+			"mode":                 v.retentionMode,
+			"retainUntilTimestamp": v.retainUntil,
+		}
+	}
+	return map[string]interface{}{
+		"accountId": m.accountID,
+		"bucketId":  b.id,
+		"fileId":    v.id,
+		"fileRetention": map[string]interface{}{
+			"isClientAuthorizedToRead": true,
+			"value":                    retention,
+		},
+		"fileName":        v.name,
+		"action":          v.action,
+		"contentLength":   len(v.data),
+		"contentSha1":     sha,
+		"contentType":     v.contentType,
+		"fileInfo":        info,
+		"uploadTimestamp": v.uploaded,
+	}
+}
+
+type mockListRequest struct {
+	BucketID      string `json:"bucketId"`
+	StartFileName string `json:"startFileName"`
+	StartFileID   string `json:"startFileId"`
+	MaxFileCount  int    `json:"maxFileCount"`
+	Prefix        string `json:"prefix"`
+	Delimiter     string `json:"delimiter"`
+}
+
+// listed returns what a listing shows for v: itself, or the folder it is in
+// if there is a delimiter after the prefix.
+func (request *mockListRequest) listed(name string) (string, bool) {
+	if request.Delimiter == "" {
+		return name, false
+	}
+	rest := strings.TrimPrefix(name, request.Prefix)
+	if i := strings.Index(rest, request.Delimiter); i >= 0 {
+		return request.Prefix + rest[:i+len(request.Delimiter)], true
+	}
+	return name, false
+}
+
+func (m *mockB2) listFileNames(r *http.Request) (interface{}, *mockError) {
+	request := &mockListRequest{}
+	if err := decodeMockRequest(r, request); err != nil {
+		return nil, err
+	}
+	b := m.buckets[request.BucketID]
+	if b == nil {
+		return nil, &mockError{http.StatusBadRequest, "bad_bucket_id"}
+	}
+	if request.MaxFileCount == 0 {
+		request.MaxFileCount = 100
+	}
+
+	files := []interface{}{}
+	next := ""
+	seen := make(map[string]bool)
+	for _, v := range b.sortedVersions() {
+		if seen[v.name] || v.name < request.StartFileName || !strings.HasPrefix(v.name, request.Prefix) {
+			continue
+		}
+		seen[v.name] = true
+		if b.current(v.name) != v {
+			continue
+		}
+
+		name, folder := request.listed(v.name)
+		if folder && seen[name] {
+			continue
+		}
+		if len(files) == request.MaxFileCount {
+			next = name
+			break
+		}
+		if folder {
+			seen[name] = true
+			files = append(files, map[string]interface{}{"fileName": name, "action": "folder"})
+			continue
+		}
+		files = append(files, m.fileJSON(b, v))
+	}
+
+	response := map[string]interface{}{"files": files, "nextFileName": nil}
+	if next != "" {
+		response["nextFileName"] = next
+	}
+	return response, nil
+}
+
+func (m *mockB2) listFileVersions(r *http.Request) (interface{}, *mockError) {
+	request := &mockListRequest{}
+	if err := decodeMockRequest(r, request); err != nil {
+		return nil, err
+	}
+	b := m.buckets[request.BucketID]
+	if b == nil {
+		return nil, &mockError{http.StatusBadRequest, "bad_bucket_id"}
+	}
+	if request.MaxFileCount == 0 {
+		request.MaxFileCount = 100
+	}
+
+	versions := b.sortedVersions()
+	start := 0
+	for start < len(versions) && versions[start].name < request.StartFileName {
+		start++
+	}
+	if request.StartFileID != "" {
+		for i := start; i < len(versions) && versions[i].name == request.StartFileName; i++ {
+			if versions[i].id == request.StartFileID {
+				start = i
+				break
+			}
+		}
+	}
+
+	files := []interface{}{}
+	response := map[string]interface{}{"nextFileName": nil, "nextFileId": nil}
+	for _, v := range versions[start:] {
+		if !strings.HasPrefix(v.name, request.Prefix) {
+			continue
+		}
+		if len(files) == request.MaxFileCount {
+			response["nextFileName"] = v.name
+			response["nextFileId"] = v.id
+			break
+		}
+		files = append(files, m.fileJSON(b, v))
+	}
+	response["files"] = files
+	return response, nil
+}
+
+func (m *mockB2) getFileInfo(r *http.Request) (interface{}, *mockError) {
+	request := struct {
+		FileID string `json:"fileId"`
+	}{}
+	if err := decodeMockRequest(r, &request); err != nil {
+		return nil, err
+	}
+
+	b, v := m.findVersion(request.FileID)
+	if v == nil || v.action != "upload" {
+		return nil, &mockError{http.StatusNotFound, "not_found"}
+	}
+	return m.fileJSON(b, v), nil
+}
+
+func (m *mockB2) hideFile(r *http.Request) (interface{}, *mockError) {
+	request := struct {
+		BucketID string `json:"bucketId"`
+		FileName string `json:"fileName"`
+	}{}
+	if err := decodeMockRequest(r, &request); err != nil {
+		return nil, err
+	}
+	b := m.buckets[request.BucketID]
+	if b == nil {
+		return nil, &mockError{http.StatusBadRequest, "bad_bucket_id"}
+	}
+	if b.current(request.FileName) == nil {
+		return nil, &mockError{http.StatusBadRequest, "already_hidden"}
+	}
+
+	v := m.addVersion(b, request.FileName, "hide", "", nil, nil)
+	return m.fileJSON(b, v), nil
+}
+
+func (m *mockB2) copyFile(r *http.Request) (interface{}, *mockError) {
+	request := struct {
+		SourceFileID        string            `json:"sourceFileId"`
+		DestinationBucketID string            `json:"destinationBucketId"`
+		FileName            string            `json:"fileName"`
+		MetadataDirective   string            `json:"metadataDirective"`
+		ContentType         string            `json:"contentType"`
+		FileInfo            map[string]string `json:"fileInfo"`
+	}{}
+	if err := decodeMockRequest(r, &request); err != nil {
+		return nil, err
+	}
+
+	b, source := m.findVersion(request.SourceFileID)
+	if source == nil || source.action != "upload" {
+		return nil, &mockError{http.StatusBadRequest, "bad_request"}
+	}
+	if request.DestinationBucketID != "" {
+		b = m.buckets[request.DestinationBucketID]
+		if b == nil {
+			return nil, &mockError{http.StatusBadRequest, "bad_bucket_id"}
+		}
+	}
+	contentType, info := source.contentType, source.info
+	if request.MetadataDirective == "REPLACE" {
+		contentType, info = request.ContentType, request.FileInfo
+	}
+
+	v := m.addVersion(b, request.FileName, "upload", contentType, info, source.data)
+	return m.fileJSON(b, v), nil
+}
+
+func (m *mockB2) deleteFileVersion(r *http.Request) (interface{}, *mockError) {
+	request := struct {
+		FileName string `json:"fileName"`
+		FileID   string `json:"fileId"`
+	}{}
+	if err := decodeMockRequest(r, &request); err != nil {
+		return nil, err
+	}
+
+	b, v := m.findVersion(request.FileID)
+	if v == nil || v.name != request.FileName {
+		return nil, &mockError{http.StatusBadRequest, "file_not_present"}
+	}
+	if v.retainUntil > time.Now().UnixNano()/int64(time.Millisecond) {
+		return nil, &mockError{http.StatusUnauthorized, "access_denied"}
+	}
+	for i := range b.versions {
+		if b.versions[i] == v {
+			b.versions = append(b.versions[:i], b.versions[i+1:]...)
+			break
+		}
+	}
+	return map[string]interface{}{"fileId": v.id, "fileName": v.name}, nil
+}
+
+func (m *mockB2) downloadByID(w http.ResponseWriter, r *http.Request) {
+	fileID := r.URL.Query().Get("fileId")
+	if fileID == "" {
+		request := struct {
+			FileID string `json:"fileId"`
+		}{}
+		if err := decodeMockRequest(r, &request); err != nil {
+			writeMockError(w, err.status, err.code, "bad request")
+			return
+		}
+		fileID = request.FileID
+	}
+
+	b, v := m.findVersion(fileID)
+	if v == nil || v.action != "upload" {
+		writeMockError(w, http.StatusNotFound, "not_found", "no such file")
+		return
+	}
+	m.serveVersion(w, r, b, v)
+}
+
+func (m *mockB2) downloadByName(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/file/"), "/", 2)
+	var b *mockBucket
+	for _, bucket := range m.buckets {
+		if len(parts) == 2 && bucket.name == parts[0] {
+			b = bucket
+		}
+	}
+	if b == nil {
+		writeMockError(w, http.StatusNotFound, "not_found", "no such bucket")
+		return
+	}
+	if b.bucketType != "allPublic" {
+		if status, code := m.checkToken(r); status != 0 {
+			writeMockError(w, status, code, "not authorized")
+			return
+		}
+	}
+
+	v := b.current(parts[1])
+	if v == nil {
+		writeMockError(w, http.StatusNotFound, "not_found", "no such file")
+		return
+	}
+	m.serveVersion(w, r, b, v)
+}
+
+func (m *mockB2) serveVersion(w http.ResponseWriter, r *http.Request, b *mockBucket, v *mockVersion) {
+	data := v.data
+	status := http.StatusOK
+	if s := r.Header.Get("Range"); s != "" {
+		var start, end int
+		_, err := fmt.Sscanf(s, "bytes=%d-%d", &start, &end)
+		if err != nil || start > end || end >= len(data) {
+			writeMockError(w, http.StatusRequestedRangeNotSatisfiable, "range_not_satisfiable", "bad range")
+			return
+		}
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	}
+
+	w.Header().Set("Content-Type", v.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("X-Bz-File-Id", v.id)
+	w.Header().Set("X-Bz-File-Name", url.QueryEscape(v.name))
+	w.Header().Set("X-Bz-Content-Sha1", v.contentSHA1())
+	w.Header().Set("X-Bz-Upload-Timestamp", strconv.FormatInt(v.uploaded, 10))
+	for k, value := range v.info {
+		w.Header().Set("X-Bz-Info-"+k, value)
+	}
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// The host that the mock hands out as the S3 endpoint. Requests for it reach
+// the mock when the remote is given the mock as its proxy.
+const mockS3Host = "s3.us-west-000.backblazeb2.test"
+
+// serveS3 handles requests to the S3-compatible API, for the api=s3 setting.
+func (m *mockB2) serveS3(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	name := ""
+	if len(parts) == 2 {
+		name = parts[1]
+	}
+
+	var api string
+	switch {
+	case name == "" && r.Method == "GET":
+		api = "s3_list_object_versions"
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		api = "s3_copy_object"
+	default:
+		api = "s3_" + strings.ToLower(r.Method) + "_object"
+	}
+	m.calls[api]++
+
+	if failures := m.failures[api]; len(failures) > 0 {
+		m.failures[api] = failures[1:]
+		writeMockS3Error(w, failures[0], "InternalError")
+		return
+	}
+
+	// Only the access key is checked, not the signature. The master
+	// application key can't be used with S3.
+	credential := strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=")
+	accessKey := strings.SplitN(credential, "/", 2)[0]
+	if accessKey == m.accountID || m.keys[accessKey] == "" {
+		writeMockS3Error(w, http.StatusForbidden, "InvalidAccessKeyId")
+		return
+	}
+
+	var b *mockBucket
+	for _, bucket := range m.buckets {
+		if bucket.name == parts[0] {
+			b = bucket
+		}
+	}
+	if b == nil {
+		writeMockS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch api {
+	case "s3_list_object_versions":
+		m.s3ListVersions(w, b, query.Get("prefix"))
+	case "s3_put_object":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeMockS3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		// Everything the remote uploads comes with its SHA1.
+		sum := sha1.Sum(data)
+		if r.Header.Get("X-Amz-Checksum-Sha1") != base64.StdEncoding.EncodeToString(sum[:]) {
+			writeMockS3Error(w, http.StatusBadRequest, "BadDigest")
+			return
+		}
+		v := m.addVersion(b, name, "upload", r.Header.Get("Content-Type"), s3MockInfo(r.Header), data)
+		setMockS3Retention(v, r.Header)
+		w.Header().Set("X-Amz-Version-Id", v.id)
+	case "s3_copy_object":
+		source, err := url.Parse(r.Header.Get("X-Amz-Copy-Source"))
+		if err != nil {
+			writeMockS3Error(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		sourceBucket, from := m.findVersion(source.Query().Get("versionId"))
+		if from == nil || from.action != "upload" || "/"+sourceBucket.name+"/"+from.name != source.Path {
+			writeMockS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		contentType, info := from.contentType, from.info
+		if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+			contentType, info = r.Header.Get("Content-Type"), s3MockInfo(r.Header)
+		}
+		v := m.addVersion(b, name, "upload", contentType, info, from.data)
+		setMockS3Retention(v, r.Header)
+		w.Header().Set("X-Amz-Version-Id", v.id)
+		fmt.Fprintf(w, "<CopyObjectResult></CopyObjectResult>")
+	case "s3_get_object", "s3_head_object":
+		v := b.current(name)
+		if id := query.Get("versionId"); id != "" {
+			_, v = m.findVersion(id)
+			if v != nil && (v.name != name || v.action != "upload") {
+				v = nil
+			}
+		}
+		if v == nil {
+			writeMockS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		m.serveS3Version(w, r, v)
+	case "s3_delete_object":
+		id := query.Get("versionId")
+		if id == "" {
+			// S3 always adds a delete marker, whether or not the object
+			// currently exists.
+			v := m.addVersion(b, name, "hide", "", nil, nil)
+			w.Header().Set("X-Amz-Delete-Marker", "true")
+			w.Header().Set("X-Amz-Version-Id", v.id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		_, v := m.findVersion(id)
+		if v == nil || v.name != name {
+			writeMockS3Error(w, http.StatusNotFound, "NoSuchVersion")
+			return
+		}
+		if v.retainUntil > time.Now().UnixNano()/int64(time.Millisecond) {
+			writeMockS3Error(w, http.StatusForbidden, "AccessDenied")
+			return
+		}
+		for i := range b.versions {
+			if b.versions[i] == v {
+				b.versions = append(b.versions[:i], b.versions[i+1:]...)
+				break
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMockS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func writeMockS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s failed</Message></Error>", code, code)
+}
+
+func s3MockInfo(h http.Header) map[string]string {
+	info := make(map[string]string)
+	for k, v := range h {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			info[strings.ToLower(strings.TrimPrefix(k, "X-Amz-Meta-"))] = v[0]
+		}
+	}
+	return info
+}
+
+func setMockS3Retention(v *mockVersion, h http.Header) {
+	until, err := time.Parse(time.RFC3339, h.Get("X-Amz-Object-Lock-Retain-Until-Date"))
+	if err != nil {
+		return
+	}
+	v.retentionMode = strings.ToLower(h.Get("X-Amz-Object-Lock-Mode"))
+	v.retainUntil = until.UnixNano() / int64(time.Millisecond)
+}
+
+func (m *mockB2) s3ListVersions(w http.ResponseWriter, b *mockBucket, prefix string) {
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, "<ListVersionsResult><IsTruncated>false</IsTruncated>")
+	for _, v := range b.sortedVersions() {
+		if !strings.HasPrefix(v.name, prefix) {
+			continue
+		}
+		modified := time.Unix(0, v.uploaded*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+		if v.action == "hide" {
+			fmt.Fprintf(w, "<DeleteMarker><Key>%s</Key><VersionId>%s</VersionId><LastModified>%s</LastModified></DeleteMarker>", v.name, v.id, modified)
+		} else {
+			fmt.Fprintf(w, "<Version><Key>%s</Key><VersionId>%s</VersionId><LastModified>%s</LastModified><Size>%d</Size></Version>", v.name, v.id, modified, len(v.data))
+		}
+	}
+	fmt.Fprintf(w, "</ListVersionsResult>")
+}
+
+func (m *mockB2) serveS3Version(w http.ResponseWriter, r *http.Request, v *mockVersion) {
+	data := v.data
+	status := http.StatusOK
+	if s := r.Header.Get("Range"); s != "" {
+		var start, end int
+		_, err := fmt.Sscanf(s, "bytes=%d-%d", &start, &end)
+		if err != nil || start > end || end >= len(data) {
+			writeMockS3Error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	}
+
+	w.Header().Set("Content-Type", v.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("X-Amz-Version-Id", v.id)
+	if r.Header.Get("X-Amz-Checksum-Mode") == "ENABLED" && status == http.StatusOK {
+		sum, _ := hex.DecodeString(v.contentSHA1())
+		w.Header().Set("X-Amz-Checksum-Sha1", base64.StdEncoding.EncodeToString(sum))
+	}
+	for k, value := range v.info {
+		w.Header().Set("X-Amz-Meta-"+k, value)
+	}
+	if v.retentionMode != "" {
+		w.Header().Set("X-Amz-Object-Lock-Mode", strings.ToUpper(v.retentionMode))
+		w.Header().Set("X-Amz-Object-Lock-Retain-Until-Date", time.Unix(0, v.retainUntil*int64(time.Millisecond)).UTC().Format(time.RFC3339))
+	}
+	w.WriteHeader(status)
+	if r.Method == "GET" {
+		w.Write(data)
+	}
+}
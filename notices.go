@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/arcnmx/go-git-annex-external/external"
+)
+
+// noticeBoard collects warnings that the git-annex user should see, which
+// nothing fails over, such as the filename cache filling up or the remote
+// authorizing again. Much of what notices them has no request to answer, so
+// they are sent along with the reply to whichever request comes next: as
+// INFO, which git-annex shows without --debug, if it supports the extension.
+// Each is only given once per process.
+type noticeBoard struct {
+	mu      sync.Mutex
+	pending []string
+	given   map[string]bool
+}
+
+var notices = &noticeBoard{}
+
+// add queues msg for the user, unless it has been given already.
+func (n *noticeBoard) add(msg string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.given[msg] {
+		return
+	}
+	if n.given == nil {
+		n.given = make(map[string]bool)
+	}
+	n.given[msg] = true
+	n.pending = append(n.pending, msg)
+}
+
+// flush sends the queued notices to git-annex.
+func (n *noticeBoard) flush(e *external.External) {
+	n.mu.Lock()
+	pending := n.pending
+	n.pending = nil
+	n.mu.Unlock()
+
+	for _, msg := range pending {
+		if e.HasExtension("INFO") {
+			e.Info(msg)
+		} else {
+			e.Debug(msg)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/arcnmx/go-git-annex-external/external"
+	"github.com/kothar/go-backblaze"
+)
+
+// With pin-versions set, the ID of the file version that each key is stored
+// as is kept in git-annex's state for the key, which is shared through the
+// git-annex branch. CHECKPRESENT and RETRIEVE then go by that exact version,
+// so that something else uploading different content under the key's name
+// doesn't go unnoticed, and a key that was hidden and stored again is never
+// mistaken for an older version. Keys with no version recorded, or whose
+// version is gone, are looked up by name as usual.
+
+// pinVersion records fileID as the version that key is stored as, or that no
+// version is if fileID is empty.
+func (be *B2Ext) pinVersion(e *external.External, key, fileID string) error {
+	if !be.pinVersions {
+		return nil
+	}
+	return e.SetState(key, fileID)
+}
+
+// pinnedVersion returns the version recorded for key and the shard that it is
+// in, or nil if there is none or it no longer exists.
+func (be *B2Ext) pinnedVersion(e *external.External, key string) (*B2Ext, *backblaze.File, error) {
+	if !be.pinVersions {
+		return nil, nil, nil
+	}
+	fileID, err := e.GetState(key)
+	if err != nil || fileID == "" {
+		return nil, nil, err
+	}
+
+	var b2file *backblaze.File
+	err = be.retry(e, "get file info", func() (err error) {
+		b2file, err = be.bucket().GetFileInfo(fileID)
+		return err
+	})
+	if b2err, ok := err.(*backblaze.B2Error); ok && b2err.Status == http.StatusNotFound {
+		e.Debug("the version of " + key + " that was stored is gone, looking it up by name")
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	shard := be.bucketIDShard(b2file.BucketID)
+	if shard == nil || b2file.Name != shard.keyName(key) {
+		// Not one of ours; the remote's buckets or prefix have changed.
+		return nil, nil, nil
+	}
+	return shard, b2file, nil
+}
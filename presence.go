@@ -0,0 +1,57 @@
+package main
+
+import (
+	"time"
+)
+
+// How long an answer to CHECKPRESENT is trusted when the key is stored right
+// after. git-annex checks just before it sends each key, so this only has to
+// cover the gap between the two.
+const presenceDuration = 15 * time.Second
+
+// Expired answers are dropped once there are this many, as most keys that are
+// checked are never stored.
+const maxPresenceChecks = 1000
+
+// presenceCheck is what CHECKPRESENT last answered for a key.
+type presenceCheck struct {
+	found bool
+	at    time.Time
+}
+
+// presenceChecked records the answer to CHECKPRESENT for key, which is stored
+// under its usual name in this bucket if found.
+func (be *B2Ext) presenceChecked(key string, found bool) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	now := time.Now()
+	if be.presence == nil {
+		be.presence = make(map[string]presenceCheck)
+	} else if len(be.presence) >= maxPresenceChecks {
+		for k, check := range be.presence {
+			if now.Sub(check.at) > presenceDuration {
+				delete(be.presence, k)
+			}
+		}
+	}
+	be.presence[key] = presenceCheck{found: found, at: now}
+}
+
+// knownAbsent reports whether CHECKPRESENT has just found that key isn't
+// stored, so that there's no need to look for it again before uploading.
+func (be *B2Ext) knownAbsent(key string) bool {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	check, ok := be.presence[key]
+	return ok && !check.found && time.Since(check.at) <= presenceDuration
+}
+
+// forgetPresence drops the answer for key once it has been stored or removed.
+func (be *B2Ext) forgetPresence(key string) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	delete(be.presence, key)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/arcnmx/go-git-annex-external/external"
+)
+
+// progressReader is external.ProgressReader, except that it starts counting
+// from an initial offset so that resumed transfers report the position within
+// the whole file.
+type progressReader struct {
+	r io.Reader
+	e *external.External
+
+	n          int64
+	lastPrintN int64
+	lastPrint  time.Time
+}
+
+func newProgressReader(r io.Reader, e *external.External, offset int64) *progressReader {
+	return &progressReader{
+		r:          r,
+		e:          e,
+		n:          offset,
+		lastPrintN: offset,
+	}
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.n += int64(n)
+	if time.Since(pr.lastPrint) > external.ProgressTimeInterval ||
+		(err != nil && pr.n != pr.lastPrintN) {
+
+		pr.e.Progress(pr.n)
+		pr.lastPrintN = pr.n
+		pr.lastPrint = time.Now()
+	}
+	return n, err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by all the transfers in one
+// direction, so that the limit holds however many jobs git-annex runs.
+type rateLimiter struct {
+	rate float64 // bytes per second
+	// Up to a second's worth of data can be sent at once after being idle.
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter for rate bytes (or requests) per second,
+// or nil for no limit.
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:   rate,
+		burst:  rate,
+		tokens: rate,
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n bytes (or requests) may be transferred.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit > 0 {
+		sleep(time.Duration(deficit / l.rate * float64(time.Second)))
+	}
+}
+
+// limitReader slows r down to l, which may be nil for no limit.
+func limitReader(r io.Reader, l *rateLimiter) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r: r, l: l}
+}
+
+type limitedReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	// Keep each read small enough that the transfer stays smooth.
+	if max := int(lr.l.burst) / 4; max > 0 && len(p) > max {
+		p = p[:max]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		lr.l.wait(n)
+	}
+	return n, err
+}
+
+// parseRate parses a transfer rate in bytes per second, such as "500k",
+// "5MiB" or "1.5MB/s". An empty rate means no limit.
+func parseRate(s string) (int64, error) {
+	return parseSize(strings.TrimSuffix(strings.TrimSpace(s), "/s"), "rate")
+}
+
+// parseSize parses a number of bytes such as "64k" or "1MiB", which is the
+// what of a setting. Decimal units are powers of 1000 and binary units powers
+// of 1024. An empty size is 0.
+func parseSize(s, what string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	number, unit := s, ""
+	if i >= 0 {
+		number, unit = s[:i], strings.TrimSpace(s[i:])
+	}
+
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("couldn't parse %v %#v", what, s)
+	}
+
+	var multiplier float64
+	switch strings.ToLower(unit) {
+	case "", "b":
+		multiplier = 1
+	case "k", "kb":
+		multiplier = 1e3
+	case "kib":
+		multiplier = 1 << 10
+	case "m", "mb":
+		multiplier = 1e6
+	case "mib":
+		multiplier = 1 << 20
+	case "g", "gb":
+		multiplier = 1e9
+	case "gib":
+		multiplier = 1 << 30
+	default:
+		return 0, fmt.Errorf("unknown unit %#v in %v %#v", unit, what, s)
+	}
+
+	return int64(n * multiplier), nil
+}
@@ -0,0 +1,1660 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The UUID that git-annex gives the remote.
+const mockRemoteUUID = "5a8c7f2e-0b7d-4e3a-9c61-2f4d8e0a1b63"
+
+// fakeAnnex plays the part of git-annex, keeping the remote's settings and
+// creds between the processes it starts.
+type fakeAnnex struct {
+	t      *testing.T
+	b2     *mockB2
+	dir    string
+	config map[string]string
+	creds  map[string][2]string
+	state  map[string]string
+}
+
+// annexProcess is one run of the remote, driven over the protocol.
+type annexProcess struct {
+	a    *fakeAnnex
+	be   *B2Ext
+	in   *io.PipeWriter
+	out  *bufio.Reader
+	done chan error
+	// The INFO messages the remote has sent.
+	infos []string
+}
+
+func newFakeAnnex(t *testing.T, config map[string]string) *fakeAnnex {
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, "B2_") {
+			os.Unsetenv(strings.SplitN(env, "=", 2)[0])
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "git-annex-remote-b2-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &fakeAnnex{
+		t:  t,
+		b2: newMockB2(),
+		config: map[string]string{
+			"accountid": mockAccountID,
+			"appkey":    mockAppKey,
+			"bucket":    "annex",
+		},
+		creds: make(map[string][2]string),
+		state: make(map[string]string),
+		dir:   dir,
+	}
+	a.config["endpoint"] = a.b2.server.URL
+	for k, v := range config {
+		a.config[k] = v
+	}
+	return a
+}
+
+func (a *fakeAnnex) close() {
+	a.b2.close()
+	os.RemoveAll(a.dir)
+}
+
+// start runs a new remote process, which is answered until it is closed.
+func (a *fakeAnnex) start() *annexProcess {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	p := &annexProcess{
+		a:    a,
+		be:   &B2Ext{},
+		in:   inW,
+		out:  bufio.NewReader(outR),
+		done: make(chan error, 1),
+	}
+	go func() {
+		p.done <- runLoop(inR, outW, p.be)
+		outW.Close()
+	}()
+
+	if line := p.readLine(); line != "VERSION 1" {
+		a.t.Fatalf("expected VERSION 1, got %#v", line)
+	}
+	return p
+}
+
+// initRemote runs initremote in a process of its own.
+func (a *fakeAnnex) initRemote() {
+	p := a.start()
+	defer p.close()
+	p.expect("INITREMOTE", "INITREMOTE-SUCCESS")
+}
+
+// prepare starts a process that is ready for transfers.
+func (a *fakeAnnex) prepare() *annexProcess {
+	p := a.start()
+	p.expect("PREPARE", "PREPARE-SUCCESS")
+	return p
+}
+
+// file writes a file to the work directory, and returns its path along with
+// a SHA1 key for it.
+func (a *fakeAnnex) file(content string) (key, path string) {
+	sum := sha1.Sum([]byte(content))
+	key = fmt.Sprintf("SHA1-s%d--%s", len(content), hex.EncodeToString(sum[:]))
+	path = filepath.Join(a.dir, key)
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return key, path
+}
+
+func (p *annexProcess) readLine() string {
+	line, err := p.out.ReadString('\n')
+	if err != nil {
+		p.a.t.Fatalf("remote exited: %v", err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+func (p *annexProcess) send(line string) {
+	_, err := io.WriteString(p.in, line+"\n")
+	if err != nil {
+		p.a.t.Fatal(err)
+	}
+}
+
+// request sends line and answers the remote's requests until it replies.
+func (p *annexProcess) request(line string) string {
+	p.send(line)
+	return p.reply()
+}
+
+// reply answers the remote's requests until it sends something else, which is
+// returned. Requests from ASYNC jobs are answered within the same job, and
+// replies keep their "J n" prefix.
+func (p *annexProcess) reply() string {
+	a := p.a
+	for {
+		line := p.readLine()
+		job := ""
+		if strings.HasPrefix(line, "J ") {
+			fields := strings.SplitN(line, " ", 3)
+			job, line = "J "+fields[1]+" ", fields[2]
+		}
+		send := func(s string) {
+			p.send(job + s)
+		}
+
+		fields := strings.SplitN(line, " ", 4)
+		switch fields[0] {
+		case "INFO":
+			p.infos = append(p.infos, strings.TrimPrefix(line, "INFO "))
+		case "DEBUG", "PROGRESS", "SETURLMISSING", "SETURLPRESENT", "SETURIMISSING", "SETURIPRESENT":
+		case "GETCONFIG":
+			send("VALUE " + a.config[fields[1]])
+		case "SETCONFIG":
+			value := ""
+			if len(fields) > 2 {
+				value = strings.Join(fields[2:], " ")
+			}
+			a.config[fields[1]] = value
+		case "GETCREDS":
+			creds := a.creds[fields[1]]
+			send("CREDS " + creds[0] + " " + creds[1])
+		case "SETCREDS":
+			if len(fields) != 4 {
+				a.t.Fatalf("bad SETCREDS: %#v", line)
+			}
+			a.creds[fields[1]] = [2]string{fields[2], fields[3]}
+		case "GETSTATE":
+			send("VALUE " + a.state[fields[1]])
+		case "SETSTATE":
+			a.state[fields[1]] = strings.Join(fields[2:], " ")
+		case "GETURLS":
+			send("VALUE ")
+		case "GETGITDIR":
+			send("VALUE " + a.dir)
+		case "GETUUID":
+			send("VALUE " + mockRemoteUUID)
+		case "ERROR":
+			a.t.Fatalf("remote failed: %v", line)
+		default:
+			return job + line
+		}
+	}
+}
+
+// expect sends line and checks for a reply starting with want.
+func (p *annexProcess) expect(line, want string) string {
+	reply := p.request(line)
+	if !strings.HasPrefix(reply, want) {
+		p.a.t.Fatalf("%v: expected %#v, got %#v", line, want, reply)
+	}
+	return reply
+}
+
+func (p *annexProcess) close() {
+	p.in.Close()
+	io.Copy(ioutil.Discard, p.out)
+	if err := <-p.done; err != nil {
+		p.a.t.Fatalf("remote exited: %v", err)
+	}
+}
+
+func TestInitRemote(t *testing.T) {
+	a := newFakeAnnex(t, nil)
+	defer a.close()
+	a.initRemote()
+
+	if a.b2.bucket("annex") == nil {
+		t.Fatal("bucket wasn't created")
+	}
+	if creds := a.creds["b2_appkey"]; creds != [2]string{mockAccountID, mockAppKey} {
+		t.Errorf("b2_appkey creds are %v", creds)
+	}
+	if a.config["appkey"] != "" {
+		t.Error("appkey was left in the settings")
+	}
+	if a.config["bucket"] != "annex" {
+		t.Errorf("bucket setting is %#v", a.config["bucket"])
+	}
+
+	// Enabling it again finds the bucket it made.
+	a.initRemote()
+	if n := a.b2.count("b2_create_bucket"); n != 1 {
+		t.Errorf("bucket was created %v times", n)
+	}
+}
+
+func TestInitRemoteBadKey(t *testing.T) {
+	a := newFakeAnnex(t, map[string]string{"appkey": "wrong"})
+	defer a.close()
+	p := a.start()
+	defer p.close()
+	p.expect("INITREMOTE", "INITREMOTE-FAILURE")
+}
+
+// TestRemote follows the steps of git annex testremote.
+func TestRemote(t *testing.T) {
+	a := newFakeAnnex(t, nil)
+	defer a.close()
+	a.initRemote()
+
+	p := a.prepare()
+	defer p.close()
+
+	content := "some content to store"
+	key, path := a.file(content)
+	retrieved := filepath.Join(a.dir, "retrieved")
+
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-FAILURE")
+	p.expect("TRANSFER RETRIEVE "+key+" "+retrieved, "TRANSFER-FAILURE RETRIEVE")
+	p.expect("REMOVE "+key, "REMOVE-SUCCESS")
+
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-SUCCESS")
+	if names := a.b2.names("annex"); len(names) != 1 || names[0] != key {
+		t.Fatalf("bucket has %v", names)
+	}
+
+	// Storing it again finds the copy that is already there.
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	if n := a.b2.count("upload"); n != 1 {
+		t.Errorf("uploaded %v times", n)
+	}
+
+	p.expect("TRANSFER RETRIEVE "+key+" "+retrieved, "TRANSFER-SUCCESS RETRIEVE")
+	data, err := ioutil.ReadFile(retrieved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content {
+		t.Errorf("retrieved %#v", string(data))
+	}
+
+	p.expect("REMOVE "+key, "REMOVE-SUCCESS")
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-FAILURE")
+	p.expect("REMOVE "+key, "REMOVE-SUCCESS")
+	if names := a.b2.names("annex"); len(names) != 0 {
+		t.Errorf("bucket still has %v", names)
+	}
+
+	// Storing it after removing it uploads it anew.
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-SUCCESS")
+
+	// Nothing is left waiting to be cancelled at shutdown.
+	inflight.mu.Lock()
+	n := len(inflight.cancels)
+	inflight.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%v requests are still tracked", n)
+	}
+}
+
+func TestRemoteAcrossProcesses(t *testing.T) {
+	a := newFakeAnnex(t, nil)
+	defer a.close()
+	a.initRemote()
+
+	key, path := a.file("stored by one process")
+	p := a.prepare()
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	p.close()
+
+	p = a.prepare()
+	defer p.close()
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-SUCCESS")
+	p.expect("REMOVE "+key, "REMOVE-SUCCESS")
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-FAILURE")
+}
+
+func TestRetryUpload(t *testing.T) {
+	a := newFakeAnnex(t, nil)
+	defer a.close()
+	a.initRemote()
+
+	p := a.prepare()
+	defer p.close()
+
+	key, path := a.file("stored on the second try")
+	a.b2.failNext("upload", 500)
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	if n := a.b2.count("upload"); n != 2 {
+		t.Errorf("uploaded %v times", n)
+	}
+
+	// Once the retries are used up, the failure gets through.
+	key, path = a.file("never stored")
+	a.b2.failNext("upload", 500, 500)
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-FAILURE STORE")
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-FAILURE")
+}
+
+func TestReauthorize(t *testing.T) {
+	a := newFakeAnnex(t, nil)
+	defer a.close()
+	a.initRemote()
+
+	p := a.prepare()
+	defer p.close()
+
+	key, path := a.file("stored with a fresh token")
+	authorized := a.b2.count("b2_authorize_account")
+	a.b2.expireTokens()
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	if a.b2.count("b2_authorize_account") == authorized {
+		t.Error("didn't authorize again")
+	}
+
+	a.b2.expireTokens()
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-SUCCESS")
+}
+
+func TestFailover(t *testing.T) {
+	a := newFakeAnnex(t, map[string]string{
+		"appkeyid":    "key1",
+		"appkey":      "secret1",
+		"appkeyid-2":  "key2",
+		"appkey-2":    "secret2",
+		"accountid":   "",
+		"bucket":      "annex",
+		"retry-count": "1",
+	})
+	defer a.close()
+	a.b2.addKey("key1", "secret1")
+	a.b2.addKey("key2", "secret2")
+	a.initRemote()
+
+	if creds := a.creds["b2_appkey_2"]; creds != [2]string{"key2", "secret2"} {
+		t.Errorf("b2_appkey_2 creds are %v", creds)
+	}
+	if a.config["appkey-2"] != "" {
+		t.Error("appkey-2 was left in the settings")
+	}
+
+	key, path := a.file("stored before the key was revoked")
+	p := a.prepare()
+	defer p.close()
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+
+	// A token that B2 doesn't know is only authorized again.
+	a.b2.forgetTokens()
+	again, path := a.file("stored after the token was lost")
+	p.expect("TRANSFER STORE "+again+" "+path, "TRANSFER-SUCCESS STORE")
+	keyIndex := func() string {
+		data, _ := ioutil.ReadFile(filepath.Join(a.dir, "annex", "b2", "appkeys", mockRemoteUUID))
+		return strings.TrimSpace(string(data))
+	}
+	if index := keyIndex(); index != "" {
+		t.Errorf("failed over to key %v after a bad token", index)
+	}
+
+	// Once the key is revoked, the process fails over to the spare, and
+	// records that it did.
+	a.b2.revokeKey("key1")
+	other, path := a.file("stored with the spare key")
+	p.expect("TRANSFER STORE "+other+" "+path, "TRANSFER-SUCCESS STORE")
+	if index := keyIndex(); index != "1" {
+		t.Errorf("recorded key %#v as the one in use", index)
+	}
+	if len(a.state) != 0 {
+		t.Errorf("recorded %v in the git-annex branch", a.state)
+	}
+
+	// A new process goes straight to the key that works.
+	authorized := a.b2.count("b2_authorize_account")
+	q := a.prepare()
+	defer q.close()
+	q.expect("CHECKPRESENT "+key, "CHECKPRESENT-SUCCESS")
+	q.expect("CHECKPRESENT "+other, "CHECKPRESENT-SUCCESS")
+	if n := a.b2.count("b2_authorize_account") - authorized; n != 2 {
+		t.Errorf("authorized %v times", n)
+	}
+}
+
+func TestFailoverAsync(t *testing.T) {
+	a := newFakeAnnex(t, map[string]string{
+		"appkeyid":    "key1",
+		"appkey":      "secret1",
+		"appkeyid-2":  "key2",
+		"appkey-2":    "secret2",
+		"accountid":   "",
+		"retry-count": "2",
+	})
+	defer a.close()
+	a.b2.addKey("key1", "secret1")
+	a.b2.addKey("key2", "secret2")
+	a.initRemote()
+
+	p := a.start()
+	defer p.close()
+	p.expect("EXTENSIONS ASYNC", "EXTENSIONS ASYNC")
+	p.expect("PREPARE", "PREPARE-SUCCESS")
+
+	// Every job finds the key revoked at once; whichever fails over first,
+	// the others carry on with the spare key.
+	stored, path := a.file("stored before the key was revoked")
+	p.expect("J 1 TRANSFER STORE "+stored+" "+path, "J 1 TRANSFER-SUCCESS STORE")
+	a.b2.revokeKey("key1")
+	want := map[string]int{}
+	for i := 1; i <= 8; i++ {
+		key, path := a.file(fmt.Sprintf("stored by job %v", i))
+		want[fmt.Sprintf("J %v TRANSFER-SUCCESS STORE %v", i, key)]++
+		p.send(fmt.Sprintf("J %v TRANSFER STORE %v %v", i, key, path))
+		for j := 0; j < 4; j++ {
+			want[fmt.Sprintf("J %v CHECKPRESENT-SUCCESS %v", i, stored)]++
+			p.send(fmt.Sprintf("J %v CHECKPRESENT %v", i, stored))
+		}
+	}
+	for len(want) > 0 {
+		reply := p.reply()
+		if want[reply] == 0 {
+			t.Fatalf("unexpected reply %#v", reply)
+		}
+		if want[reply]--; want[reply] == 0 {
+			delete(want, reply)
+		}
+	}
+	if names := a.b2.names("annex"); len(names) != 9 {
+		t.Errorf("bucket has %v", names)
+	}
+}
+
+func TestCacheFilenames(t *testing.T) {
+	a := newFakeAnnex(t, map[string]string{"cache-filenames": "true"})
+	defer a.close()
+	a.initRemote()
+
+	key, path := a.file("listed once")
+	other, _ := a.file("never stored")
+
+	p := a.prepare()
+	defer p.close()
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+
+	listed := a.b2.count("b2_list_file_names")
+	for i := 0; i < 3; i++ {
+		p.expect("CHECKPRESENT "+key, "CHECKPRESENT-SUCCESS")
+		p.expect("CHECKPRESENT "+other, "CHECKPRESENT-FAILURE")
+	}
+	if n := a.b2.count("b2_list_file_names") - listed; n > 1 {
+		t.Errorf("listed the bucket %v more times", n)
+	}
+
+	p.expect("REMOVE "+key, "REMOVE-SUCCESS")
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-FAILURE")
+}
+
+func TestCacheLRU(t *testing.T) {
+	a := newFakeAnnex(t, map[string]string{
+		"cache-filenames": "true",
+		"cache-max-files": "1000",
+		"cache-lru":       "true",
+	})
+	defer a.close()
+	a.initRemote()
+
+	// Enough keys to fill three pages of the listing.
+	keys := make([]string, 3000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("SHA1-s1--%040x", i)
+		a.b2.replace("annex", keys[i], []byte("x"))
+	}
+
+	p := a.prepare()
+	defer p.close()
+
+	listed := a.b2.count("b2_list_file_names")
+	checkListed := func(key string, want int) {
+		t.Helper()
+		p.expect("CHECKPRESENT "+key, "CHECKPRESENT-SUCCESS")
+		n := a.b2.count("b2_list_file_names") - listed
+		if n != want {
+			t.Errorf("checking %v listed %v times, expected %v", key, n, want)
+		}
+		listed += n
+	}
+	checkListed(keys[0], 1)
+	checkListed(keys[10], 0)
+	// The first page is dropped to make room for this one.
+	checkListed(keys[1500], 1)
+	checkListed(keys[1600], 0)
+	checkListed(keys[10], 1)
+}
+
+func TestCacheMaxFiles(t *testing.T) {
+	a := newFakeAnnex(t, map[string]string{
+		"cache-filenames": "true",
+		"cache-max-files": "2",
+	})
+	defer a.close()
+	a.initRemote()
+
+	p := a.prepare()
+	defer p.close()
+	var keys []string
+	for _, content := range []string{"first", "second", "third"} {
+		key, path := a.file(content)
+		p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+		keys = append(keys, key)
+	}
+
+	listed := a.b2.count("b2_list_file_names")
+	checkListed := func(key string, want int) {
+		t.Helper()
+		p.expect("CHECKPRESENT "+key, "CHECKPRESENT-SUCCESS")
+		n := a.b2.count("b2_list_file_names") - listed
+		if n != want {
+			t.Errorf("checking %v listed %v times, expected %v", key, n, want)
+		}
+		listed += n
+	}
+	checkListed(keys[2], 0)
+	checkListed(keys[1], 0)
+	// Pushed out by the third.
+	checkListed(keys[0], 1)
+}
+
+func TestCheckPresentHead(t *testing.T) {
+	a := newFakeAnnex(t, map[string]string{"checkpresent-mode": "head"})
+	defer a.close()
+	a.initRemote()
+
+	key, path := a.file("looked up without listing")
+	p := a.prepare()
+	defer p.close()
+
+	listed := a.b2.count("b2_list_file_names")
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-FAILURE")
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-SUCCESS")
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	if n := a.b2.count("upload"); n != 1 {
+		t.Errorf("uploaded %v times", n)
+	}
+
+	a.b2.expireTokens()
+	p.expect("REMOVE "+key, "REMOVE-SUCCESS")
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-FAILURE")
+	if n := a.b2.count("b2_list_file_names"); n != listed {
+		t.Errorf("listed %v names", n-listed)
+	}
+}
+
+func TestStoreAfterCheckPresent(t *testing.T) {
+	a := newFakeAnnex(t, nil)
+	defer a.close()
+	a.initRemote()
+
+	key, path := a.file("checked, then stored")
+	other, _ := a.file("checked in between")
+	p := a.prepare()
+	defer p.close()
+
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-FAILURE")
+	p.expect("CHECKPRESENT "+other, "CHECKPRESENT-FAILURE")
+	listed := a.b2.count("b2_list_file_names")
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	if n := a.b2.count("b2_list_file_names"); n != listed {
+		t.Errorf("listed %v names before uploading", n-listed)
+	}
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-SUCCESS")
+}
+
+func TestSkipVerify(t *testing.T) {
+	a := newFakeAnnex(t, map[string]string{"skip-verify": "true"})
+	defer a.close()
+	a.initRemote()
+
+	key, path := a.file("trusted to be there")
+	p := a.prepare()
+	defer p.close()
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+
+	q := a.prepare()
+	defer q.close()
+	q.expect("CHECKPRESENT "+key, "CHECKPRESENT-SUCCESS")
+	q.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	if n := a.b2.count("upload"); n != 1 {
+		t.Errorf("uploaded %v times", n)
+	}
+	if n := a.b2.count("b2_get_file_info"); n != 0 {
+		t.Errorf("got file info %v times", n)
+	}
+}
+
+func TestUploadLock(t *testing.T) {
+	a := newFakeAnnex(t, map[string]string{"upload-lock": "true"})
+	defer a.close()
+	a.initRemote()
+
+	key, path := a.file("sent by two processes at once")
+	p := a.prepare()
+	defer p.close()
+	q := a.prepare()
+	defer q.close()
+
+	// The second process starts while the first is still uploading.
+	a.b2.slowUploads(300 * time.Millisecond)
+	replies := make(chan string, 1)
+	go func() {
+		replies <- p.request("TRANSFER STORE " + key + " " + path)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	q.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	if reply := <-replies; !strings.HasPrefix(reply, "TRANSFER-SUCCESS STORE") {
+		t.Errorf("first process replied %#v", reply)
+	}
+	if n := a.b2.count("upload"); n != 1 {
+		t.Errorf("uploaded %v times", n)
+	}
+
+	if locks, _ := filepath.Glob(filepath.Join(a.dir, "annex", "b2", "uploads", "*")); len(locks) != 0 {
+		t.Errorf("left behind locks %v", locks)
+	}
+}
+
+func TestBucketCache(t *testing.T) {
+	a := newFakeAnnex(t, nil)
+	defer a.close()
+	a.initRemote()
+
+	b := a.b2.bucket("annex")
+	if want := "annex:" + b.id + ":allPrivate"; a.config["bucket-cache"] != want {
+		t.Errorf("bucket-cache is %#v, expected %#v", a.config["bucket-cache"], want)
+	}
+
+	listed := a.b2.count("b2_list_buckets")
+	key, path := a.file("stored in a cached bucket")
+	p := a.prepare()
+	defer p.close()
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-SUCCESS")
+	if n := a.b2.count("b2_list_buckets"); n != listed {
+		t.Errorf("listed buckets %v times", n-listed)
+	}
+
+	// A bucket that was made again under the same name is found again.
+	a.b2.recreateBucket("annex")
+	key, path = a.file("stored in the new bucket")
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-FAILURE")
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	if names := a.b2.names("annex"); len(names) != 1 || names[0] != key {
+		t.Errorf("bucket has %v", names)
+	}
+}
+
+func TestRestrictedKey(t *testing.T) {
+	a := newFakeAnnex(t, map[string]string{
+		"accountid": "",
+		"appkeyid":  "restricted",
+		"appkey":    "secret",
+	})
+	defer a.close()
+	a.b2.addBucket("annex", "allPrivate")
+	a.b2.addBucket("elsewhere", "allPrivate")
+	a.b2.restrictKey("restricted", "secret", "annex")
+
+	// The key can only list the bucket it is restricted to.
+	a.initRemote()
+	key, path := a.file("stored with a restricted key")
+	a.config["bucket-cache"] = ""
+	p := a.prepare()
+	defer p.close()
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	if names := a.b2.names("annex"); len(names) != 1 || names[0] != key {
+		t.Errorf("bucket has %v", names)
+	}
+
+	a.config["bucket"] = "elsewhere"
+	p = a.start()
+	defer p.close()
+	if reply := p.expect("PREPARE", "PREPARE-FAILURE"); !strings.Contains(reply, "only has access to bucket") {
+		t.Errorf("PREPARE: %#v", reply)
+	}
+}
+
+func TestResumeRetrieve(t *testing.T) {
+	a := newFakeAnnex(t, nil)
+	defer a.close()
+	a.initRemote()
+
+	content := "the first half, and then the second half"
+	key, path := a.file(content)
+
+	p := a.prepare()
+	defer p.close()
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+
+	retrieved := filepath.Join(a.dir, "partial")
+	err := ioutil.WriteFile(retrieved, []byte(content[:15]), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.expect("TRANSFER RETRIEVE "+key+" "+retrieved, "TRANSFER-SUCCESS RETRIEVE")
+	data, err := ioutil.ReadFile(retrieved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content {
+		t.Errorf("retrieved %#v", string(data))
+	}
+}
+
+func TestAppendOnly(t *testing.T) {
+	a := newFakeAnnex(t, map[string]string{"appendonly": "true"})
+	defer a.close()
+	a.initRemote()
+
+	key, path := a.file("kept forever")
+	p := a.prepare()
+	defer p.close()
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	p.expect("REMOVE "+key, "REMOVE-FAILURE")
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-SUCCESS")
+}
+
+func TestShards(t *testing.T) {
+	a := newFakeAnnex(t, map[string]string{"bucket": "", "buckets": "annex-a,annex-b"})
+	defer a.close()
+	a.initRemote()
+	if a.b2.bucket("annex-a") == nil || a.b2.bucket("annex-b") == nil {
+		t.Fatal("buckets weren't created")
+	}
+
+	authorized := a.b2.count("b2_authorize_account")
+	p := a.prepare()
+	defer p.close()
+	// The buckets share the one authorization, which is made by both
+	// go-backblaze and the API client.
+	if n := a.b2.count("b2_authorize_account") - authorized; n != 2 {
+		t.Errorf("authorized %v times", n)
+	}
+
+	var keys []string
+	for i := 0; i < 8; i++ {
+		key, path := a.file(fmt.Sprintf("shard %v", i))
+		p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+		keys = append(keys, key)
+	}
+	stored := len(a.b2.names("annex-a")) + len(a.b2.names("annex-b"))
+	if stored != len(keys) {
+		t.Errorf("stored %v keys across the buckets", stored)
+	}
+	if len(a.b2.names("annex-a")) == 0 || len(a.b2.names("annex-b")) == 0 {
+		t.Error("every key went to the same bucket")
+	}
+
+	for _, key := range keys {
+		p.expect("CHECKPRESENT "+key, "CHECKPRESENT-SUCCESS")
+		p.expect("REMOVE "+key, "REMOVE-SUCCESS")
+		p.expect("CHECKPRESENT "+key, "CHECKPRESENT-FAILURE")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	for _, codec := range []string{"gzip", "zstd"} {
+		t.Run(codec, func(t *testing.T) {
+			a := newFakeAnnex(t, map[string]string{"compression": codec})
+			defer a.close()
+			a.initRemote()
+
+			content := strings.Repeat("timestamp,level,message\n", 1000)
+			key, path := a.file(content)
+			p := a.prepare()
+			defer p.close()
+			p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+
+			names := a.b2.names("annex")
+			if len(names) != 1 {
+				t.Fatalf("stored %v", names)
+			}
+			v := a.b2.bucket("annex").current(names[0])
+			if len(v.data) >= len(content) || v.info["compression"] != codec {
+				t.Errorf("stored %v bytes with file info %v", len(v.data), v.info)
+			}
+
+			retrieved := filepath.Join(a.dir, "retrieved")
+			p.expect("TRANSFER RETRIEVE "+key+" "+retrieved, "TRANSFER-SUCCESS RETRIEVE")
+			data, err := ioutil.ReadFile(retrieved)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != content {
+				t.Errorf("retrieved %v bytes", len(data))
+			}
+
+			// The stored file is recognised as the key's content, even
+			// though its SHA1 is of something else.
+			p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+			if n := a.b2.count("upload"); n != 1 {
+				t.Errorf("uploaded %v times", n)
+			}
+		})
+	}
+}
+
+func TestPinVersions(t *testing.T) {
+	a := newFakeAnnex(t, map[string]string{"pin-versions": "true"})
+	defer a.close()
+	a.initRemote()
+
+	content := "the content that was stored"
+	key, path := a.file(content)
+	p := a.prepare()
+	defer p.close()
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	if a.state[key] == "" {
+		t.Fatal("no version was recorded")
+	}
+
+	names := a.b2.names("annex")
+	if len(names) != 1 {
+		t.Fatalf("stored %v", names)
+	}
+	a.b2.replace("annex", names[0], []byte("something else entirely"))
+
+	retrieved := filepath.Join(a.dir, "retrieved")
+	p.expect("TRANSFER RETRIEVE "+key+" "+retrieved, "TRANSFER-SUCCESS RETRIEVE")
+	data, err := ioutil.ReadFile(retrieved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content {
+		t.Errorf("retrieved %#v", string(data))
+	}
+
+	p.expect("REMOVE "+key, "REMOVE-SUCCESS")
+	if a.state[key] != "" {
+		t.Errorf("still recorded %v", a.state[key])
+	}
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-FAILURE")
+}
+
+func TestNotices(t *testing.T) {
+	a := newFakeAnnex(t, map[string]string{
+		"cache-filenames": "true",
+		"cache-max-files": "1",
+	})
+	defer a.close()
+	a.initRemote()
+
+	key, path := a.file("one")
+	// Sorts before the key, so the cache doesn't cover it.
+	absent := "SHA1-s0--" + strings.Repeat("0", 40)
+
+	p := a.start()
+	defer p.close()
+	if reply := p.request("EXTENSIONS INFO ASYNC"); !strings.Contains(reply, " INFO") {
+		t.Fatalf("INFO wasn't negotiated: %#v", reply)
+	}
+	p.expect("PREPARE", "PREPARE-SUCCESS")
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	if len(p.infos) != 0 {
+		t.Errorf("unexpected notices: %v", p.infos)
+	}
+
+	p.expect("CHECKPRESENT "+absent, "CHECKPRESENT-FAILURE")
+	if len(p.infos) != 1 || !strings.Contains(p.infos[0], "cache is full") {
+		t.Errorf("notices: %v", p.infos)
+	}
+}
+
+func TestURLs(t *testing.T) {
+	a := newFakeAnnex(t, nil)
+	defer a.close()
+	a.initRemote()
+	a.b2.addBucket("elsewhere", "allPrivate")
+
+	key, path := a.file("added by URL")
+	p := a.prepare()
+	defer p.close()
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+
+	for _, url := range []string{
+		"https://f000.backblazeb2.com/file/annex/" + key,
+		"https://f003.backblazeb2.com/file/annex/" + key,
+		"b2://annex/" + key,
+	} {
+		p.expect("CLAIMURL "+url, "CLAIMURL-SUCCESS")
+		if reply := p.expect("CHECKURL "+url, "CHECKURL-CONTENTS"); !strings.HasSuffix(reply, " "+key) {
+			t.Errorf("%v: %#v", url, reply)
+		}
+	}
+
+	missing := "b2://annex/SHA1-s0--" + strings.Repeat("0", 40)
+	p.expect("CLAIMURL "+missing, "CLAIMURL-SUCCESS")
+	p.expect("CHECKURL "+missing, "CHECKURL-FAILURE")
+
+	// URLs of other buckets and hosts aren't the remote's, but checking them
+	// doesn't end the session.
+	for _, url := range []string{
+		"https://f000.backblazeb2.com/file/elsewhere/" + key,
+		"b2://elsewhere/" + key,
+		"https://f000.backblazeb2.com/" + key,
+		"https://example.com/file/annex/" + key,
+	} {
+		p.expect("CLAIMURL "+url, "CLAIMURL-FAILURE")
+		p.expect("CHECKURL "+url, "CHECKURL-FAILURE")
+	}
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-SUCCESS")
+}
+
+// gc runs git-annex-remote-b2 gc against the remote's bucket, with config
+// added to the command line settings, and returns what it printed.
+func (a *fakeAnnex) gc(config map[string]string) string {
+	settings := cliConfig{
+		"accountid": mockAccountID,
+		"appkey":    mockAppKey,
+		"bucket":    a.config["bucket"],
+		"endpoint":  a.config["endpoint"],
+	}
+	for k, v := range config {
+		settings[k] = v
+	}
+
+	be := &B2Ext{}
+	err := be.setup(settings, false)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	var out strings.Builder
+	err = be.gc(&out, false, time.Hour)
+	if err != nil {
+		a.t.Fatalf("gc: %v\n%v", err, out.String())
+	}
+	return out.String()
+}
+
+func TestGC(t *testing.T) {
+	a := newFakeAnnex(t, map[string]string{"retention-days": "1"})
+	defer a.close()
+	a.initRemote()
+
+	kept, path := a.file("stored twice")
+	dropped, other := a.file("dropped")
+	p := a.prepare()
+	defer p.close()
+	p.expect("TRANSFER STORE "+kept+" "+path, "TRANSFER-SUCCESS STORE")
+	a.b2.replace("annex", kept, []byte("stored twice"))
+	p.expect("TRANSFER STORE "+dropped+" "+other, "TRANSFER-SUCCESS STORE")
+	p.expect("REMOVE "+dropped, "REMOVE-SUCCESS")
+
+	// The hide marker stays for as long as the upload below it is retained,
+	// whatever retention is set to now.
+	out := a.gc(nil)
+	if !strings.Contains(out, "0 file versions deleted") {
+		t.Errorf("gc while retained:\n%v", out)
+	}
+	p.expect("CHECKPRESENT "+dropped, "CHECKPRESENT-FAILURE")
+
+	a.b2.expireRetention()
+	out = a.gc(map[string]string{"retention-days": "1"})
+	if !strings.Contains(out, "3 file versions deleted") {
+		t.Errorf("gc:\n%v", out)
+	}
+	if n := len(a.b2.bucket("annex").versions); n != 1 {
+		t.Errorf("%v versions left", n)
+	}
+	p.expect("CHECKPRESENT "+kept, "CHECKPRESENT-SUCCESS")
+	p.expect("CHECKPRESENT "+dropped, "CHECKPRESENT-FAILURE")
+}
+
+func TestRetention(t *testing.T) {
+	a := newFakeAnnex(t, map[string]string{"retention-days": "1", "delete-mode": "delete"})
+	defer a.close()
+	a.initRemote()
+
+	key, path := a.file("retained for a day")
+	p := a.prepare()
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	if reply := p.expect("REMOVE "+key, "REMOVE-FAILURE"); !strings.Contains(reply, "retained by Object Lock until") {
+		t.Errorf("REMOVE: %#v", reply)
+	}
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-SUCCESS")
+	p.close()
+
+	// It is the retention of the file that counts, not the setting.
+	a.config["retention-days"] = ""
+	p = a.prepare()
+	p.expect("REMOVE "+key, "REMOVE-FAILURE")
+	a.b2.expireRetention()
+	p.expect("REMOVE "+key, "REMOVE-SUCCESS")
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-FAILURE")
+	p.close()
+
+	// Hiding it isn't refused, so nothing has to be listed first.
+	a.config["delete-mode"] = "hide"
+	a.config["retention-days"] = "1"
+	p = a.prepare()
+	defer p.close()
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	listed := a.b2.count("b2_list_file_versions")
+	p.expect("REMOVE "+key, "REMOVE-SUCCESS")
+	if n := a.b2.count("b2_list_file_versions"); n != listed {
+		t.Errorf("listed versions %v times", n-listed)
+	}
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-FAILURE")
+}
+
+// listImportable runs LISTIMPORTABLECONTENTS, and returns the content
+// identifier of each file by its name.
+func (p *annexProcess) listImportable() map[string]string {
+	contents := make(map[string]string)
+	line := p.request("LISTIMPORTABLECONTENTS")
+	name := ""
+	for line != "END" {
+		fields := strings.SplitN(line, " ", 3)
+		switch fields[0] {
+		case "CONTENT":
+			name = fields[2]
+		case "CONTENTIDENTIFIER":
+			contents[name] = fields[1]
+		default:
+			p.a.t.Fatalf("LISTIMPORTABLECONTENTS: %#v", line)
+		}
+		line = p.readLine()
+	}
+	return contents
+}
+
+func TestImportConflict(t *testing.T) {
+	a := newFakeAnnex(t, map[string]string{"prefix": "tree"})
+	defer a.close()
+	a.initRemote()
+
+	key, path := a.file("exported, then changed by someone else")
+	p := a.prepare()
+	defer p.close()
+	p.send("EXPORT notes.txt")
+	p.expect("TRANSFEREXPORT STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	cid := p.listImportable()["notes.txt"]
+	if cid == "" {
+		t.Fatal("notes.txt wasn't listed")
+	}
+
+	p.send("EXPORT notes.txt")
+	p.expect("CHECKPRESENTEXPORT "+key, "CHECKPRESENT-SUCCESS")
+	a.b2.replace("annex", "tree/notes.txt", []byte("changed"))
+	p.send("EXPORT notes.txt")
+	p.expect("STOREEXPORTEXPECTED "+cid+" "+key+" "+path, "STOREEXPORTEXPECTED-FAILURE")
+	p.send("EXPORT notes.txt")
+	p.expect("REMOVEEXPORTEXPECTED "+cid, "REMOVEEXPORTEXPECTED-FAILURE")
+	if v := a.b2.bucket("annex").current("tree/notes.txt"); v == nil || string(v.data) != "changed" {
+		t.Error("the change was overwritten")
+	}
+
+	cid = p.listImportable()["notes.txt"]
+	p.send("EXPORT notes.txt")
+	cid = strings.TrimPrefix(p.expect("STOREEXPORTEXPECTED "+cid+" "+key+" "+path, "STOREEXPORTEXPECTED-SUCCESS"), "STOREEXPORTEXPECTED-SUCCESS ")
+	p.send("EXPORT notes.txt")
+	p.expect("REMOVEEXPORTEXPECTED "+cid, "REMOVEEXPORTEXPECTED-SUCCESS")
+	p.send("EXPORT notes.txt")
+	p.expect("CHECKPRESENTEXPORT "+key, "CHECKPRESENT-FAILURE")
+}
+
+func TestAsync(t *testing.T) {
+	a := newFakeAnnex(t, nil)
+	defer a.close()
+	a.initRemote()
+
+	slow, path := a.file("stored slowly by the first job")
+	other, _ := a.file("checked by the second job")
+	p := a.start()
+	defer p.close()
+	p.expect("EXTENSIONS ASYNC", "EXTENSIONS ASYNC")
+	p.expect("PREPARE", "PREPARE-SUCCESS")
+
+	// The first job has more requests queued up than it can take while it
+	// is busy, which mustn't hold up the second.
+	a.b2.slowUploads(500 * time.Millisecond)
+	started := time.Now()
+	p.send("J 1 TRANSFER STORE " + slow + " " + path)
+	for i := 0; i < 100; i++ {
+		p.send("J 1 GETCOST")
+	}
+	p.send("J 2 CHECKPRESENT " + other)
+	if reply := p.reply(); reply != "J 2 CHECKPRESENT-FAILURE "+other {
+		t.Fatalf("expected the second job to reply first, got %#v", reply)
+	}
+	if d := time.Since(started); d > 400*time.Millisecond {
+		t.Errorf("the second job took %v", d)
+	}
+
+	if reply := p.reply(); reply != "J 1 TRANSFER-SUCCESS STORE "+slow {
+		t.Fatalf("expected the first job to finish, got %#v", reply)
+	}
+	for i := 0; i < 100; i++ {
+		if reply := p.reply(); reply != "J 1 COST 200" {
+			t.Fatalf("reply %v to GETCOST: %#v", i, reply)
+		}
+	}
+
+	// Both jobs share the bucket and what is known about it.
+	p.expect("J 2 CHECKPRESENT "+slow, "J 2 CHECKPRESENT-SUCCESS")
+	p.expect("J 3 REMOVE "+slow, "J 3 REMOVE-SUCCESS")
+	p.expect("J 1 CHECKPRESENT "+slow, "J 1 CHECKPRESENT-FAILURE")
+}
+
+func TestCopy(t *testing.T) {
+	a := newFakeAnnex(t, nil)
+	defer a.close()
+	a.initRemote()
+
+	content := "stored as a key, then exported"
+	key, path := a.file(content)
+	p := a.prepare()
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	p.close()
+
+	// A later process copies what the bucket has under the key's name.
+	p = a.prepare()
+	defer p.close()
+	p.send("EXPORT docs/a.txt")
+	p.expect("TRANSFEREXPORT STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	if n := a.b2.count("b2_copy_file"); n != 1 {
+		t.Errorf("copied %v times", n)
+	}
+	if n := a.b2.count("upload"); n != 1 {
+		t.Errorf("uploaded %v times", n)
+	}
+	if v := a.b2.bucket("annex").current("docs/a.txt"); v == nil || string(v.data) != content {
+		t.Fatal("docs/a.txt wasn't exported")
+	}
+
+	// Renaming it copies it too.
+	p.send("EXPORT docs/a.txt")
+	p.expect("RENAMEEXPORT "+key+" docs/b.txt", "RENAMEEXPORT-SUCCESS")
+	if names := a.b2.names("annex"); len(names) != 2 || names[0] != key || names[1] != "docs/b.txt" {
+		t.Errorf("bucket has %v", names)
+	}
+	if n := a.b2.count("upload"); n != 1 {
+		t.Errorf("uploaded %v times", n)
+	}
+}
+
+func TestCopySkipVerify(t *testing.T) {
+	a := newFakeAnnex(t, map[string]string{"skip-verify": "true"})
+	defer a.close()
+	a.initRemote()
+
+	// Something else is under the key's name, which storing it trusts, but
+	// exporting it doesn't copy.
+	content := "the real content"
+	key, path := a.file(content)
+	a.b2.replace("annex", key, []byte("something else"))
+	p := a.prepare()
+	defer p.close()
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	p.send("EXPORT a.txt")
+	p.expect("TRANSFEREXPORT STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	if n := a.b2.count("b2_copy_file"); n != 0 {
+		t.Errorf("copied %v times", n)
+	}
+	if v := a.b2.bucket("annex").current("a.txt"); v == nil || string(v.data) != content {
+		t.Errorf("exported the wrong content")
+	}
+}
+
+// newS3Annex returns a fakeAnnex with a remote that uses the S3 API, which
+// can't be used with the master application key.
+func newS3Annex(t *testing.T, config map[string]string) *fakeAnnex {
+	a := newFakeAnnex(t, config)
+	a.config["api"] = "s3"
+	a.config["accountid"] = ""
+	a.config["appkeyid"] = "s3key"
+	a.config["appkey"] = "s3secret"
+	a.config["proxy"] = a.b2.server.URL
+	a.b2.addKey("s3key", "s3secret")
+	return a
+}
+
+func TestS3(t *testing.T) {
+	a := newS3Annex(t, nil)
+	defer a.close()
+	a.initRemote()
+
+	p := a.prepare()
+	defer p.close()
+
+	content := "stored through the S3 API"
+	key, path := a.file(content)
+	retrieved := filepath.Join(a.dir, "retrieved")
+
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-SUCCESS")
+	p.expect("TRANSFER RETRIEVE "+key+" "+retrieved, "TRANSFER-SUCCESS RETRIEVE")
+	data, err := ioutil.ReadFile(retrieved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content {
+		t.Errorf("retrieved %#v", string(data))
+	}
+	p.expect("REMOVE "+key, "REMOVE-SUCCESS")
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-FAILURE")
+
+	for _, api := range []string{"s3_put_object", "s3_get_object", "s3_delete_object"} {
+		if a.b2.count(api) == 0 {
+			t.Errorf("%v wasn't called", api)
+		}
+	}
+	for _, api := range []string{"upload", "download", "b2_download_file_by_id", "b2_hide_file"} {
+		if n := a.b2.count(api); n != 0 {
+			t.Errorf("%v was called %v times", api, n)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	for name, newAnnex := range map[string]func(*testing.T, map[string]string) *fakeAnnex{
+		"b2": newFakeAnnex,
+		"s3": newS3Annex,
+	} {
+		newAnnex := newAnnex
+		t.Run(name, func(t *testing.T) {
+			a := newAnnex(t, map[string]string{"retry-count": "0"})
+			defer a.close()
+			a.initRemote()
+
+			key, path := a.file("checked on the way in and out")
+			p := a.prepare()
+			defer p.close()
+			p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+
+			a.b2.corrupt("annex", key)
+			retrieved := filepath.Join(a.dir, "retrieved")
+			if reply := p.expect("TRANSFER RETRIEVE "+key+" "+retrieved, "TRANSFER-FAILURE RETRIEVE"); !strings.Contains(reply, "SHA1") {
+				t.Errorf("RETRIEVE: %#v", reply)
+			}
+		})
+	}
+}
+
+func TestS3Versions(t *testing.T) {
+	a := newS3Annex(t, map[string]string{"delete-mode": "delete", "retention-days": "1"})
+	defer a.close()
+	a.initRemote()
+
+	key, path := a.file("retained for a day")
+	p := a.prepare()
+	defer p.close()
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	if reply := p.expect("REMOVE "+key, "REMOVE-FAILURE"); !strings.Contains(reply, "retained by Object Lock until") {
+		t.Errorf("REMOVE: %#v", reply)
+	}
+
+	a.b2.expireRetention()
+	p.expect("REMOVE "+key, "REMOVE-SUCCESS")
+	if n := len(a.b2.bucket("annex").versions); n != 0 {
+		t.Errorf("%v versions left", n)
+	}
+
+	// Renaming an export copies it.
+	p.send("EXPORT a.txt")
+	p.expect("TRANSFEREXPORT STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	a.b2.expireRetention()
+	p.send("EXPORT a.txt")
+	p.expect("RENAMEEXPORT "+key+" b.txt", "RENAMEEXPORT-SUCCESS")
+	if names := a.b2.names("annex"); len(names) != 1 || names[0] != "b.txt" {
+		t.Errorf("bucket has %v", names)
+	}
+	if n := a.b2.count("s3_copy_object"); n != 1 {
+		t.Errorf("copied %v times", n)
+	}
+
+	for _, api := range []string{"b2_list_file_versions", "b2_delete_file_version", "b2_copy_file", "b2_hide_file"} {
+		if n := a.b2.count(api); n != 0 {
+			t.Errorf("%v was called %v times", api, n)
+		}
+	}
+}
+
+func TestS3AppendOnly(t *testing.T) {
+	a := newS3Annex(t, map[string]string{"appendonly": "true"})
+	defer a.close()
+	a.initRemote()
+
+	// Content that something else hid is still there.
+	key, path := a.file("hidden by something else")
+	p := a.prepare()
+	defer p.close()
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	a.b2.hide("annex", key)
+	p.expect("CHECKPRESENT "+key, "CHECKPRESENT-SUCCESS")
+	if n := a.b2.count("s3_list_object_versions"); n != 1 {
+		t.Errorf("listed versions %v times", n)
+	}
+	if n := a.b2.count("b2_list_file_versions"); n != 0 {
+		t.Errorf("b2_list_file_versions was called %v times", n)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	a := newFakeAnnex(t, nil)
+	defer a.close()
+	a.initRemote()
+
+	p := a.prepare()
+	defer p.close()
+	info := make(map[string]string)
+	for line := p.request("GETINFO"); line != "INFOEND"; line = p.reply() {
+		field := strings.TrimPrefix(line, "INFOFIELD ")
+		value := strings.TrimPrefix(p.reply(), "INFOVALUE ")
+		info[field] = value
+	}
+
+	if v := info["large file uploads"]; !strings.Contains(v, "5000000000 bytes") {
+		t.Errorf("large file uploads: %#v", v)
+	}
+	if v := info["recommended part size"]; v != "100000000 bytes" {
+		t.Errorf("recommended part size: %#v", v)
+	}
+
+	// A file over the limit is refused without trying to upload it.
+	path := filepath.Join(a.dir, "big")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Truncate(maxUploadSize + 1)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.expect("TRANSFER STORE WORM-s5000000001--big "+path, "TRANSFER-FAILURE STORE")
+	if n := a.b2.count("upload"); n != 0 {
+		t.Errorf("uploaded %v times", n)
+	}
+}
+
+func TestExport(t *testing.T) {
+	a := newFakeAnnex(t, map[string]string{"prefix": "tree"})
+	defer a.close()
+	a.initRemote()
+
+	p := a.prepare()
+	defer p.close()
+	p.expect("EXPORTSUPPORTED", "EXPORTSUPPORTED-SUCCESS")
+
+	content := "exported into a directory"
+	key, path := a.file(content)
+	other, otherPath := a.file("exported next to it")
+	p.send("EXPORT docs/a.txt")
+	p.expect("TRANSFEREXPORT STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	p.send("EXPORT docs/sub/b.txt")
+	p.expect("TRANSFEREXPORT STORE "+other+" "+otherPath, "TRANSFER-SUCCESS STORE")
+	p.send("EXPORT top.txt")
+	p.expect("TRANSFEREXPORT STORE "+other+" "+otherPath, "TRANSFER-SUCCESS STORE")
+	if names := a.b2.names("annex"); len(names) != 3 || names[0] != "tree/docs/a.txt" {
+		t.Fatalf("bucket has %v", names)
+	}
+
+	p.send("EXPORT docs/a.txt")
+	p.expect("CHECKPRESENTEXPORT "+key, "CHECKPRESENT-SUCCESS")
+	retrieved := filepath.Join(a.dir, "retrieved")
+	p.send("EXPORT docs/a.txt")
+	p.expect("TRANSFEREXPORT RETRIEVE "+key+" "+retrieved, "TRANSFER-SUCCESS RETRIEVE")
+	data, err := ioutil.ReadFile(retrieved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content {
+		t.Errorf("retrieved %#v", string(data))
+	}
+
+	p.send("EXPORT docs/a.txt")
+	p.expect("RENAMEEXPORT "+key+" docs/c.txt", "RENAMEEXPORT-SUCCESS")
+	p.send("EXPORT docs/a.txt")
+	p.expect("CHECKPRESENTEXPORT "+key, "CHECKPRESENT-FAILURE")
+	p.send("EXPORT docs/c.txt")
+	p.expect("CHECKPRESENTEXPORT "+key, "CHECKPRESENT-SUCCESS")
+
+	// Everything under the directory goes, and nothing else.
+	p.expect("REMOVEEXPORTDIRECTORY docs", "REMOVEEXPORTDIRECTORY-SUCCESS")
+	if names := a.b2.names("annex"); len(names) != 1 || names[0] != "tree/top.txt" {
+		t.Errorf("bucket has %v", names)
+	}
+	p.send("EXPORT docs/c.txt")
+	p.expect("CHECKPRESENTEXPORT "+key, "CHECKPRESENT-FAILURE")
+
+	p.send("EXPORT top.txt")
+	p.expect("REMOVEEXPORT "+other, "REMOVE-SUCCESS")
+	p.send("EXPORT top.txt")
+	p.expect("CHECKPRESENTEXPORT "+other, "CHECKPRESENT-FAILURE")
+	if names := a.b2.names("annex"); len(names) != 0 {
+		t.Errorf("bucket has %v", names)
+	}
+
+	p.be.mu.Lock()
+	defer p.be.mu.Unlock()
+	if len(p.be.exportNames) != 0 {
+		t.Errorf("still holding export names %v", p.be.exportNames)
+	}
+}
+
+func TestImport(t *testing.T) {
+	a := newFakeAnnex(t, map[string]string{"prefix": "tree"})
+	defer a.close()
+	a.initRemote()
+
+	p := a.prepare()
+	defer p.close()
+	p.expect("IMPORTSUPPORTED", "IMPORTSUPPORTED-SUCCESS")
+
+	// Files put in the bucket by something else are listed along with
+	// exported ones, but nothing outside of the prefix is.
+	key, path := a.file("exported")
+	p.send("EXPORT exported.txt")
+	p.expect("TRANSFEREXPORT STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	a.b2.replace("annex", "tree/dir/added.txt", []byte("added by someone else"))
+	a.b2.replace("annex", "elsewhere.txt", []byte("not in the tree"))
+	a.b2.replace("annex", "tree/hidden.txt", []byte("hidden"))
+	a.b2.hide("annex", "tree/hidden.txt")
+
+	contents := p.listImportable()
+	if len(contents) != 2 || contents["exported.txt"] == "" || contents["dir/added.txt"] == "" {
+		t.Fatalf("listed %v", contents)
+	}
+
+	// What was imported can be fetched by its content identifier, even once
+	// it has been replaced.
+	cid := contents["dir/added.txt"]
+	a.b2.replace("annex", "tree/dir/added.txt", []byte("replaced"))
+	retrieved := filepath.Join(a.dir, "retrieved")
+	p.send("EXPORT dir/added.txt")
+	p.expect("RETRIEVEEXPORTEXPECTED "+cid+" "+retrieved, "RETRIEVEEXPORTEXPECTED-SUCCESS")
+	data, err := ioutil.ReadFile(retrieved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "added by someone else" {
+		t.Errorf("retrieved %#v", string(data))
+	}
+	os.Remove(retrieved)
+	p.send("EXPORT dir/added.txt")
+	p.expect("RETRIEVEEXPORTEXPECTED 4_zmissing "+retrieved, "RETRIEVEEXPORTEXPECTED-FAILURE")
+
+	// Storing and removing with the right content identifier go ahead.
+	cid = p.listImportable()["dir/added.txt"]
+	p.send("EXPORT dir/added.txt")
+	cid = strings.TrimPrefix(p.expect("STOREEXPORTEXPECTED "+cid+" "+key+" "+path, "STOREEXPORTEXPECTED-SUCCESS"), "STOREEXPORTEXPECTED-SUCCESS ")
+	if v := a.b2.bucket("annex").current("tree/dir/added.txt"); v == nil || v.id != cid || string(v.data) != "exported" {
+		t.Errorf("stored %+v as %v", v, cid)
+	}
+	p.send("EXPORT dir/added.txt")
+	p.expect("REMOVEEXPORTEXPECTED "+cid, "REMOVEEXPORTEXPECTED-SUCCESS")
+	// Removing what is already gone is fine.
+	p.send("EXPORT dir/added.txt")
+	p.expect("REMOVEEXPORTEXPECTED "+cid, "REMOVEEXPORTEXPECTED-SUCCESS")
+	p.expect("REMOVEEXPORTDIRECTORYWHENEMPTY dir", "REMOVEEXPORTDIRECTORYWHENEMPTY-SUCCESS")
+
+	if contents := p.listImportable(); len(contents) != 1 || contents["exported.txt"] == "" {
+		t.Errorf("listed %v", contents)
+	}
+}
+
+func TestDownloadConcurrency(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		annex func(t *testing.T) *fakeAnnex
+		// The API each part is fetched with.
+		api string
+	}{
+		{"b2", func(t *testing.T) *fakeAnnex {
+			return newFakeAnnex(t, nil)
+		}, "b2_download_file_by_id"},
+		{"s3", func(t *testing.T) *fakeAnnex {
+			return newS3Annex(t, nil)
+		}, "s3_get_object"},
+		{"download-url", func(t *testing.T) *fakeAnnex {
+			a := newFakeAnnex(t, nil)
+			a.config["download-url"] = a.b2.server.URL
+			return a
+		}, "download"},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			a := test.annex(t)
+			defer a.close()
+			a.config["download-concurrency"] = "4"
+			a.initRemote()
+
+			// Big enough to be split, though not into all four parts.
+			content := strings.Repeat("0123456789abcdef", (3*minDownloadPartSize+100)/16)
+			key, path := a.file(content)
+			small, smallPath := a.file("too small to split")
+			p := a.prepare()
+			defer p.close()
+			p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+			p.expect("TRANSFER STORE "+small+" "+smallPath, "TRANSFER-SUCCESS STORE")
+
+			retrieve := func(key, name string) string {
+				retrieved := filepath.Join(a.dir, name)
+				p.expect("TRANSFER RETRIEVE "+key+" "+retrieved, "TRANSFER-SUCCESS RETRIEVE")
+				data, err := ioutil.ReadFile(retrieved)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return string(data)
+			}
+
+			downloads := a.b2.count(test.api)
+			if retrieve(key, "retrieved") != content {
+				t.Error("retrieved the wrong content")
+			}
+			if n := a.b2.count(test.api) - downloads; n != 3 {
+				t.Errorf("downloaded in %v parts", n)
+			}
+
+			downloads = a.b2.count(test.api)
+			if retrieve(small, "retrieved small") != "too small to split" {
+				t.Error("retrieved the wrong content")
+			}
+			if n := a.b2.count(test.api) - downloads; n > 1 {
+				t.Errorf("downloaded in %v parts", n)
+			}
+
+			// A part that fails is retried, and the file still comes out
+			// whole.
+			downloads = a.b2.count(test.api)
+			a.b2.failNext(test.api, 503)
+			if retrieve(key, "retrieved again") != content {
+				t.Error("retrieved the wrong content after a failure")
+			}
+			if n := a.b2.count(test.api) - downloads; n < 4 {
+				t.Errorf("downloaded in %v parts", n)
+			}
+		})
+	}
+}
+
+func TestDownloadURL(t *testing.T) {
+	a := newFakeAnnex(t, nil)
+	defer a.close()
+
+	// Something in front of B2, such as a CDN.
+	var mu sync.Mutex
+	var paths []string
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		a.b2.ServeHTTP(w, r)
+	}))
+	defer cdn.Close()
+	a.config["download-url"] = cdn.URL + "/"
+	a.initRemote()
+
+	content := "downloaded through the CDN"
+	key, path := a.file(content)
+	p := a.prepare()
+	defer p.close()
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+
+	retrieved := filepath.Join(a.dir, "retrieved")
+	p.expect("TRANSFER RETRIEVE "+key+" "+retrieved, "TRANSFER-SUCCESS RETRIEVE")
+	data, err := ioutil.ReadFile(retrieved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content {
+		t.Errorf("retrieved %#v", string(data))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(paths) != 1 || paths[0] != "/file/annex/"+key {
+		t.Errorf("the CDN was asked for %v", paths)
+	}
+}
+
+func TestCredsCommand(t *testing.T) {
+	a := newFakeAnnex(t, map[string]string{
+		"accountid":     "",
+		"appkey":        "",
+		"creds-command": "printf 'secret1\\nkeyid: key1\\n'",
+	})
+	defer a.close()
+	a.b2.addKey("key1", "secret1")
+	a.initRemote()
+
+	// Whatever the command prints is never saved.
+	if creds, ok := a.creds["b2_appkey"]; ok {
+		t.Errorf("saved %v in the creds", creds)
+	}
+	if a.config["appkey"] != "" {
+		t.Errorf("saved %#v in the config", a.config["appkey"])
+	}
+
+	key, path := a.file("stored with a key from the command")
+	p := a.prepare()
+	p.expect("TRANSFER STORE "+key+" "+path, "TRANSFER-SUCCESS STORE")
+	p.close()
+
+	a.config["creds-command"] = "echo no key >&2; exit 1"
+	p = a.start()
+	defer p.close()
+	if reply := p.expect("PREPARE", "PREPARE-FAILURE"); !strings.Contains(reply, "creds-command failed") || !strings.Contains(reply, "no key") {
+		t.Errorf("PREPARE: %#v", reply)
+	}
+}
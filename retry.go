@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/arcnmx/go-git-annex-external/external"
+	"github.com/kothar/go-backblaze"
+)
+
+// transientError marks a failure that didn't come from the B2 API but is
+// still worth retrying, such as a connection dropping halfway through a
+// download.
+type transientError struct {
+	err error
+}
+
+func (te transientError) Error() string {
+	return te.err.Error()
+}
+
+// transient wraps network errors returned by go-backblaze as a transientError.
+func transient(err error) error {
+	if _, ok := err.(*url.Error); ok {
+		return transientError{err}
+	}
+	return err
+}
+
+func isRetryable(err error) bool {
+	switch err := err.(type) {
+	case *backblaze.B2Error:
+		return !err.IsFatal() || isThrottled(err)
+	case transientError:
+		return true
+	default:
+		return false
+	}
+}
+
+// isCapExceeded reports whether err means that the B2 account has used up
+// its daily allowance of downloads or transactions.
+func isCapExceeded(err error) bool {
+	b2err, ok := err.(*backblaze.B2Error)
+	return ok && b2err.Status == http.StatusForbidden && b2err.Code == "cap_exceeded"
+}
+
+// capReset returns when the caps that are exceeded at now are reset, which
+// is at midnight GMT.
+func capReset(now time.Time) time.Time {
+	y, m, d := now.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+// Being throttled is retried at most this many times per operation, on top of
+// the retry count.
+const maxThrottledAttempts = 10
+
+// throttledUntil is the time B2 last asked for requests to be held off until
+// with Retry-After, in Unix nanoseconds. It applies to every request, since
+// B2 limits the whole account.
+var throttledUntil int64
+
+// isThrottled reports whether err means that B2 is too busy or is limiting
+// the rate of requests, rather than that the request went wrong.
+func isThrottled(err error) bool {
+	b2err, ok := err.(*backblaze.B2Error)
+	return ok && (b2err.Status == http.StatusTooManyRequests || b2err.Status == http.StatusServiceUnavailable)
+}
+
+// throttleWait returns how long to wait before the nth attempt after being
+// throttled, which is as long as B2 asked for if it did.
+func throttleWait(n int) time.Duration {
+	if wait := time.Until(time.Unix(0, atomic.LoadInt64(&throttledUntil))); wait > 0 {
+		return wait
+	}
+
+	wait := time.Duration(1<<uint(n-1)) * time.Second
+	if wait > time.Minute {
+		wait = time.Minute
+	}
+	return wait
+}
+
+// retryAfterTransport keeps track of the Retry-After header of throttled
+// responses, which go-backblaze doesn't pass on.
+type retryAfterTransport struct {
+	base http.RoundTripper
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if until, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			atomic.StoreInt64(&throttledUntil, until.UnixNano())
+		}
+	}
+	return resp, nil
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date.
+func parseRetryAfter(s string) (time.Time, bool) {
+	if s == "" {
+		return time.Time{}, false
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+		return time.Now().Add(time.Duration(n) * time.Second), true
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// isExpiredAuth reports whether err means that the authorization token used
+// for a request is no longer valid. B2 tokens only last for a day.
+func isExpiredAuth(err error) bool {
+	b2err, ok := err.(*backblaze.B2Error)
+	return ok && b2err.Status == http.StatusUnauthorized &&
+		(b2err.Code == "expired_auth_token" || b2err.Code == "bad_auth_token")
+}
+
+// retry calls attempt up to retries+1 times for as long as it fails with a
+// retryable error, backing off exponentially in between. An expired
+// authorization is renewed and tried again straight away, and being
+// throttled waits for as long as B2 asks; neither counts as a retry. Nothing
+// is retried once the process has been interrupted.
+func (be *B2Ext) retry(e *external.External, what string, attempt func() error) error {
+	var err error
+	reauthorized := false
+	reopened := false
+	throttled := 0
+	for i := uint(0); i < uint(be.retries+1); i++ {
+		if i > 0 {
+			wait := time.Duration(1<<(i-1)) * time.Second
+			e.Debug(fmt.Sprintf("%v failed, retrying in %v, error: %v", what, wait, err))
+			if !sleep(wait) {
+				return errShutdown
+			}
+			stats.retried()
+		}
+
+		bucket := be.bucket()
+		err = attempt()
+		if (isExpiredAuth(err) || isUnauthorized(err)) && !reauthorized {
+			reauthorized = true
+			e.Debug(fmt.Sprintf("%v failed, reauthorizing, error: %v", what, err))
+			notices.add("B2 no longer accepts the authorization token, authorizing again")
+			notices.flush(e)
+			err = be.reauthorize()
+			if err != nil {
+				return err
+			}
+			stats.retried()
+			err = attempt()
+		}
+		if isBucketGone(err) && !reopened {
+			reopened = true
+			e.Debug(fmt.Sprintf("%v failed, looking up the bucket again, error: %v", what, err))
+			err = be.retryReopened(bucket, err, attempt)
+		}
+		if isCapExceeded(err) {
+			if !be.capWait {
+				return fmt.Errorf("%v; the B2 account has reached one of its caps, which can be raised on the Backblaze website or reset at midnight GMT", err)
+			}
+			wait := time.Until(capReset(time.Now()))
+			e.Debug(fmt.Sprintf("%v failed, waiting %v for the B2 caps to reset, error: %v", what, wait, err))
+			notices.add("the B2 account has reached one of its caps, waiting until midnight GMT for it to reset")
+			notices.flush(e)
+			if !sleep(wait) {
+				return errShutdown
+			}
+			stats.retried()
+			err = attempt()
+		}
+		for isThrottled(err) && throttled < maxThrottledAttempts {
+			throttled++
+			wait := throttleWait(throttled)
+			e.Debug(fmt.Sprintf("%v throttled, retrying in %v, error: %v", what, wait, err))
+			if !sleep(wait) {
+				return errShutdown
+			}
+			stats.retried()
+			err = attempt()
+		}
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+		if shuttingDown() {
+			return errShutdown
+		}
+	}
+	return err
+}
+
+// transientReader marks read errors from a download body as transient.
+type transientReader struct {
+	r io.Reader
+}
+
+func (tr transientReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = transientError{err}
+	}
+	return n, err
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kothar/go-backblaze"
+)
+
+// s3Client transfers file contents through B2's S3-compatible API, which
+// addresses the same files as the native API. B2 reports the file ID of each
+// version as its S3 version ID.
+type s3Client struct {
+	endpoint string
+	region   string
+	bucket   string
+	sse      sseConfig
+	lock     fileLock
+
+	// mu guards the key, which changes when failing over to another one.
+	mu        sync.Mutex
+	accessKey string
+	secretKey string
+}
+
+// newS3Client returns a client for bucket at endpoint, the s3ApiUrl that
+// b2_authorize_account gave for the account.
+func newS3Client(endpoint, bucket string, creds backblaze.Credentials, sse sseConfig, lock fileLock) (*s3Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	// s3.<region>.backblazeb2.com
+	parts := strings.Split(u.Host, ".")
+	if len(parts) < 2 || parts[0] != "s3" {
+		return nil, fmt.Errorf("couldn't find the region of S3 endpoint %#v", endpoint)
+	}
+
+	s3 := &s3Client{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		region:   parts[1],
+		bucket:   bucket,
+		sse:      sse,
+		lock:     lock,
+	}
+	s3.setKey(creds)
+	return s3, nil
+}
+
+// setKey makes the client sign requests with the application key in creds.
+func (s3 *s3Client) setKey(creds backblaze.Credentials) {
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+
+	s3.accessKey = creds.KeyID
+	if s3.accessKey == "" {
+		s3.accessKey = creds.AccountID
+	}
+	s3.secretKey = creds.ApplicationKey
+}
+
+// putObject uploads size bytes from r as name and returns the new version. B2
+// checks what arrives against sha, the SHA1 of the content, the same as it
+// does for uploads through the native API.
+func (s3 *s3Client) putObject(name, contentType string, info map[string]string, r io.Reader, size int64, sha []byte) (*backblaze.File, error) {
+	req, err := s3.newRequest("PUT", name, nil, r)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Amz-Checksum-Sha1", base64.StdEncoding.EncodeToString(sha))
+	setFileInfoHeaders(req.Header, "X-Amz-Meta-", info)
+	s3.sse.setHeaders(req.Header, "X-Amz-", true)
+	s3.lock.setS3Headers(req.Header, time.Now())
+
+	resp, err := s3.do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	// The response describes the upload rather than the object, so it has
+	// neither its length nor its SHA1.
+	b2file := s3File(name, resp)
+	b2file.ContentLength = size
+	b2file.ContentSha1 = hex.EncodeToString(sha)
+	return b2file, nil
+}
+
+// getObject downloads name, or the version fileID of it if that is set.
+func (s3 *s3Client) getObject(name, fileID string, fileRange *backblaze.FileRange) (*backblaze.File, io.ReadCloser, error) {
+	query := url.Values{}
+	if fileID != "" {
+		query.Set("versionId", fileID)
+	}
+	req, err := s3.newRequest("GET", name, query, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fileRange != nil {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", fileRange.Start, fileRange.End))
+	}
+	// So that the download can be verified.
+	req.Header.Set("X-Amz-Checksum-Mode", "ENABLED")
+	s3.sse.setHeaders(req.Header, "X-Amz-", false)
+
+	resp, err := s3.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s3File(name, resp), resp.Body, nil
+}
+
+// headObject reports whether name currently exists.
+func (s3 *s3Client) headObject(name string) (bool, error) {
+	req, err := s3.newRequest("HEAD", name, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	s3.sse.setHeaders(req.Header, "X-Amz-", false)
+
+	resp, err := s3.do(req)
+	if b2err, ok := err.(*backblaze.B2Error); ok && b2err.Status == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	return true, nil
+}
+
+// deleteObject hides name, the same as Bucket.HideFile.
+func (s3 *s3Client) deleteObject(name string) error {
+	req, err := s3.newRequest("DELETE", name, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s3.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// deleteObjectVersion permanently deletes the version fileID of name, the same
+// as Bucket.DeleteFileVersion.
+func (s3 *s3Client) deleteObjectVersion(name, fileID string) error {
+	req, err := s3.newRequest("DELETE", name, url.Values{"versionId": {fileID}}, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s3.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// copyObject makes a new version of name with the contents of the version
+// sourceID of sourceName, the same as b2_copy_file with the REPLACE metadata
+// directive.
+func (s3 *s3Client) copyObject(sourceName, sourceID, name, contentType string, info map[string]string) (*backblaze.File, error) {
+	req, err := s3.newRequest("PUT", name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Amz-Copy-Source", "/"+s3.bucket+"/"+s3Escape(sourceName)+"?versionId="+url.QueryEscape(sourceID))
+	req.Header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	req.Header.Set("Content-Type", contentType)
+	setFileInfoHeaders(req.Header, "X-Amz-Meta-", info)
+	// Everything in the remote was stored with the same key.
+	s3.sse.setHeaders(req.Header, "X-Amz-Copy-Source-", false)
+	s3.sse.setHeaders(req.Header, "X-Amz-", true)
+	s3.lock.setS3Headers(req.Header, time.Now())
+
+	resp, err := s3.do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return s3File(name, resp), nil
+}
+
+type s3ListVersionsResult struct {
+	IsTruncated         bool
+	NextKeyMarker       string
+	NextVersionIdMarker string
+	// Versions and delete markers, in the order they are listed.
+	Entries []s3VersionEntry `xml:",any"`
+}
+
+type s3VersionEntry struct {
+	XMLName      xml.Name
+	Key          string
+	VersionId    string
+	LastModified time.Time
+	Size         int64
+}
+
+// listObjectVersions returns every version of name, newest first, with its
+// delete markers as hide markers, the same as paging through
+// b2_list_file_versions. S3 doesn't list retention, so if retention is set,
+// each upload is looked at to find its own.
+func (s3 *s3Client) listObjectVersions(name string, retention bool) ([]fileVersion, error) {
+	var versions []fileVersion
+	query := url.Values{
+		"versions": {""},
+		"prefix":   {name},
+	}
+	for {
+		req, err := s3.newRequest("GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s3.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListVersionsResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse the list of versions: %v", err)
+		}
+
+		for _, entry := range result.Entries {
+			if entry.Key != name {
+				continue
+			}
+			var file fileVersion
+			file.ID = entry.VersionId
+			file.Name = entry.Key
+			file.UploadTimestamp = entry.LastModified.UnixNano() / int64(time.Millisecond)
+			switch entry.XMLName.Local {
+			case "Version":
+				file.Action = backblaze.Upload
+				file.ContentLength = entry.Size
+				if retention {
+					file.FileRetention.Value, err = s3.objectRetention(name, entry.VersionId)
+					if err != nil {
+						return nil, err
+					}
+				}
+			case "DeleteMarker":
+				file.Action = backblaze.Hide
+			default:
+				continue
+			}
+			versions = append(versions, file)
+		}
+
+		if !result.IsTruncated {
+			return versions, nil
+		}
+		query.Set("key-marker", result.NextKeyMarker)
+		query.Set("version-id-marker", result.NextVersionIdMarker)
+	}
+}
+
+// objectRetention returns the Object Lock retention of the version fileID of
+// name, or nil if it has none.
+func (s3 *s3Client) objectRetention(name, fileID string) (*fileRetention, error) {
+	req, err := s3.newRequest("HEAD", name, url.Values{"versionId": {fileID}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	s3.sse.setHeaders(req.Header, "X-Amz-", false)
+
+	resp, err := s3.do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	mode := resp.Header.Get("X-Amz-Object-Lock-Mode")
+	if mode == "" {
+		return nil, nil
+	}
+	until, err := time.Parse(time.RFC3339, resp.Header.Get("X-Amz-Object-Lock-Retain-Until-Date"))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse the retention of %v: %v", name, err)
+	}
+	return &fileRetention{
+		Mode:                 strings.ToLower(mode),
+		RetainUntilTimestamp: until.UnixNano() / int64(time.Millisecond),
+	}, nil
+}
+
+func s3File(name string, resp *http.Response) *backblaze.File {
+	b2file := &backblaze.File{
+		ID:          resp.Header.Get("X-Amz-Version-Id"),
+		Name:        name,
+		ContentType: resp.Header.Get("Content-Type"),
+		FileInfo:    make(map[string]string),
+	}
+	b2file.ContentLength, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	// B2 gives the SHA1 of the content as its own header, or as the S3
+	// checksum if asked for it.
+	if sha := resp.Header.Get("X-Bz-Content-Sha1"); sha != "" {
+		b2file.ContentSha1 = sha
+	} else if sum, err := base64.StdEncoding.DecodeString(resp.Header.Get("X-Amz-Checksum-Sha1")); err == nil && len(sum) == sha1.Size {
+		b2file.ContentSha1 = hex.EncodeToString(sum)
+	}
+	for k, v := range resp.Header {
+		if strings.HasPrefix(k, "X-Amz-Meta-") && len(v) > 0 {
+			key := strings.ToLower(strings.TrimPrefix(k, "X-Amz-Meta-"))
+			b2file.FileInfo[key], _ = url.QueryUnescape(v[0])
+		}
+	}
+	return b2file
+}
+
+func (s3 *s3Client) newRequest(method, name string, query url.Values, body io.Reader) (*http.Request, error) {
+	u, err := url.Parse(s3.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	// An empty name addresses the bucket itself.
+	u.Path = "/" + s3.bucket
+	u.RawPath = "/" + s3.bucket
+	if name != "" {
+		u.Path += "/" + name
+		u.RawPath += "/" + s3Escape(name)
+	}
+	u.RawQuery = query.Encode()
+
+	return http.NewRequest(method, u.String(), body)
+}
+
+// do signs and sends req, turning S3 error responses into B2Errors so that
+// they are retried the same way as those of the native API.
+func (s3 *s3Client) do(req *http.Request) (*http.Response, error) {
+	s3.sign(req, time.Now().UTC())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, transient(err)
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	s3err := struct {
+		Code    string
+		Message string
+	}{}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if xml.Unmarshal(body, &s3err) != nil || s3err.Code == "" {
+		s3err.Code = "UNKNOWN"
+		s3err.Message = "Unrecognised status code"
+	}
+	return nil, &backblaze.B2Error{
+		Code:    s3err.Code,
+		Message: s3err.Message,
+		Status:  resp.StatusCode,
+	}
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req. The body
+// is left unsigned so that it can be streamed; TLS already protects it, and
+// uploads carry its SHA1 for B2 to check.
+func (s3 *s3Client) sign(req *http.Request, now time.Time) {
+	const payloadHash = "UNSIGNED-PAYLOAD"
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host": req.URL.Host,
+	}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" {
+			headers[name] = strings.Join(values, ",")
+		}
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(headers[name]))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		// url.Values.Encode sorts by name and escapes the way S3 expects,
+		// except for spaces.
+		strings.Replace(req.URL.RawQuery, "+", "%20", -1),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	s3.mu.Lock()
+	accessKey, secretKey := s3.accessKey, s3.secretKey
+	s3.mu.Unlock()
+
+	scope := date + "/" + s3.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, s3.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// s3Escape escapes a file name for use in a path, leaving only the characters
+// that SigV4 leaves unescaped.
+func s3Escape(name string) string {
+	var b strings.Builder
+	for _, c := range []byte(name) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// parseBuckets splits the buckets setting into the names of the buckets that
+// the remote is sharded across.
+func parseBuckets(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("empty bucket name in buckets %#v", s)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("bucket %#v is listed twice in buckets", name)
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// setupShards opens the rest of the buckets that the remote is sharded
+// across. Each gets the same settings and authorization as be, and its own
+// filename cache.
+func (be *B2Ext) setupShards(config configValues, names []string, canCreateBucket bool) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	shards := []*B2Ext{be}
+	for _, name := range names[1:] {
+		config.bucketName = name
+		shard := &B2Ext{
+			b2Auth:         be.b2Auth,
+			remoteSettings: be.remoteSettings,
+			cache:          be.cache.settings(),
+		}
+		err := shard.configureBucket(config, canCreateBucket)
+		if err != nil {
+			return fmt.Errorf("bucket %#v: %v", name, err)
+		}
+		shards = append(shards, shard)
+	}
+	be.shards = shards
+	return nil
+}
+
+// shardFor returns the bucket that key is stored in. Every chunk of a file
+// goes to the same one.
+func (be *B2Ext) shardFor(key string) *B2Ext {
+	if len(be.shards) == 0 {
+		return be
+	}
+	sum := md5.Sum([]byte(nonChunkKey(key)))
+	return be.shards[binary.BigEndian.Uint32(sum[:4])%uint32(len(be.shards))]
+}
+
+// keyShards returns the buckets in the order to look for key in: the one it
+// is stored in, then the others, which it may have been stored in before
+// buckets changed.
+func (be *B2Ext) keyShards(key string) []*B2Ext {
+	shard := be.shardFor(key)
+	shards := []*B2Ext{shard}
+	for _, other := range be.shards {
+		if other != shard {
+			shards = append(shards, other)
+		}
+	}
+	return shards
+}
+
+// storedShard returns the bucket that key is stored in, or nil if it isn't in
+// any of them.
+func (be *B2Ext) storedShard(key string) (*B2Ext, error) {
+	for _, shard := range be.keyShards(key) {
+		found, err := shard.checkPresent(shard.keyName(key))
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			return shard, nil
+		}
+	}
+	return nil, nil
+}
+
+// bucketShard returns the shard for the bucket called bucketName.
+func (be *B2Ext) bucketShard(bucketName string) *B2Ext {
+	for _, shard := range be.shards {
+		if shard.bucket().Name == bucketName {
+			return shard
+		}
+	}
+	if be.bucket().Name == bucketName {
+		return be
+	}
+	return nil
+}
+
+// bucketIDShard returns the shard for the bucket with the ID bucketID.
+func (be *B2Ext) bucketIDShard(bucketID string) *B2Ext {
+	for _, shard := range be.shards {
+		if shard.bucket().ID == bucketID {
+			return shard
+		}
+	}
+	if be.bucket().ID == bucketID {
+		return be
+	}
+	return nil
+}
+
+// bucketNames lists the buckets the remote is sharded across.
+func (be *B2Ext) bucketNames() string {
+	var names []string
+	for _, shard := range be.shards {
+		names = append(names, shard.bucket().Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// removeKey removes key from every bucket, so that a copy stored under an
+// earlier mapping doesn't linger.
+func (be *B2Ext) removeKey(key string) error {
+	for _, shard := range be.keyShards(key) {
+		err := shard.removeFile(shard.keyName(key))
+		if err != nil {
+			return err
+		}
+		shard.forgetPresence(key)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var errShutdown = errors.New("interrupted")
+
+// shutdown is closed once the process has been asked to stop.
+var shutdown = make(chan struct{})
+
+// How long requests have to fail and be reported to git-annex after an
+// interrupt before the process exits regardless.
+const shutdownGrace = 5 * time.Second
+
+func shuttingDown() bool {
+	select {
+	case <-shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for d, and reports whether it did so without being
+// interrupted.
+func sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-shutdown:
+		return false
+	}
+}
+
+// handleSignals cancels every request in flight on SIGINT or SIGTERM, so that
+// transfers fail and are reported as such rather than the process being
+// killed halfway through them. The process exits once git-annex closes its
+// input, or after shutdownGrace or a second signal if it doesn't.
+func handleSignals(h *B2Ext) {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-c
+		logs.logf(levelInfo, "received %v, shutting down", sig)
+		close(shutdown)
+
+		inflight.cancelAll()
+
+		select {
+		case <-c:
+		case <-time.After(shutdownGrace):
+		}
+		exit(h, 1)
+	}()
+}
+
+var exitOnce sync.Once
+
+// exit writes the statistics of the session and exits with code. The process
+// ends up here either once git-annex is done with it or once an interrupt's
+// grace is up, and whichever comes second waits for the first.
+func exit(h *B2Ext, code int) {
+	exitOnce.Do(func() {
+		err := h.writeStats()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "git-annex-remote-b2: couldn't write stats: %v\n", err)
+		}
+		os.Exit(code)
+	})
+}
+
+// requests are the requests in flight, which are cancelled at shutdown.
+type requests struct {
+	mu      sync.Mutex
+	next    int
+	cancels map[int]context.CancelFunc
+}
+
+var inflight = &requests{cancels: make(map[int]context.CancelFunc)}
+
+// add tracks a request that is cancelled with cancel, and returns a func to
+// be called, as many times as need be, once it is done with.
+func (r *requests) add(cancel context.CancelFunc) func() {
+	r.mu.Lock()
+	id := r.next
+	r.next++
+	r.cancels[id] = cancel
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		delete(r.cancels, id)
+		r.mu.Unlock()
+		cancel()
+	}
+}
+
+func (r *requests) cancelAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, cancel := range r.cancels {
+		cancel()
+	}
+}
+
+// shutdownTransport cancels requests once the process is asked to stop,
+// which go-backblaze has no way of doing itself. Requests are tracked in
+// inflight rather than each being watched by a goroutine of its own, which
+// would be left behind by a response that is never closed.
+type shutdownTransport struct {
+	base http.RoundTripper
+}
+
+func (t *shutdownTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if shuttingDown() {
+		return nil, errShutdown
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	done := inflight.add(cancel)
+	// Anything added after the interrupt missed being cancelled with the
+	// rest.
+	if shuttingDown() {
+		done()
+		return nil, errShutdown
+	}
+
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		done()
+		if shuttingDown() {
+			err = errShutdown
+		}
+		return nil, err
+	}
+
+	resp.Body = &cancelReader{r: resp.Body, done: done}
+	return resp, nil
+}
+
+// cancelReader stops tracking a request once its response has been read to
+// the end or closed, whichever comes first.
+type cancelReader struct {
+	r    io.ReadCloser
+	done func()
+}
+
+func (cr *cancelReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if err == io.EOF {
+		cr.done()
+	} else if err != nil && shuttingDown() {
+		err = errShutdown
+	}
+	return n, err
+}
+
+func (cr *cancelReader) Close() error {
+	err := cr.r.Close()
+	cr.done()
+	return err
+}
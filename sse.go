@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+)
+
+// Server-side encryption modes.
+const (
+	// Encrypted with keys that Backblaze manages.
+	sseB2 = "b2"
+	// Encrypted with a key that is sent along with every upload and
+	// download, which Backblaze doesn't keep.
+	sseC = "c"
+)
+
+type sseConfig struct {
+	mode string
+	key  []byte
+}
+
+// parseSSE checks a server-side encryption setting, and for sse=c the
+// base64 encoded AES-256 key.
+func parseSSE(mode, key string) (sseConfig, error) {
+	switch mode {
+	case "", "none":
+		return sseConfig{}, nil
+	case sseB2:
+		return sseConfig{mode: mode}, nil
+	case sseC:
+		k, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return sseConfig{}, fmt.Errorf("couldn't decode the SSE-C key: %v", err)
+		}
+		if len(k) != 32 {
+			return sseConfig{}, fmt.Errorf("the SSE-C key must be 32 bytes, not %v", len(k))
+		}
+		return sseConfig{mode: mode, key: k}, nil
+	default:
+		return sseConfig{}, fmt.Errorf("unknown server-side encryption %#v, expected none, b2 or c", mode)
+	}
+}
+
+func (c sseConfig) String() string {
+	if c.mode == "" {
+		return "none"
+	}
+	return c.mode
+}
+
+// params returns the encryption for API calls that take it in their JSON
+// request rather than as headers, or nil for none.
+func (c sseConfig) params() *serverSideEncryption {
+	switch c.mode {
+	case sseB2:
+		return &serverSideEncryption{Mode: "SSE-B2", Algorithm: "AES256"}
+	case sseC:
+		sum := md5.Sum(c.key)
+		return &serverSideEncryption{
+			Mode:           "SSE-C",
+			Algorithm:      "AES256",
+			CustomerKey:    base64.StdEncoding.EncodeToString(c.key),
+			CustomerKeyMd5: base64.StdEncoding.EncodeToString(sum[:]),
+		}
+	default:
+		return nil
+	}
+}
+
+// setHeaders adds the server-side encryption headers to a request. prefix is
+// "X-Bz-" for the native API and "X-Amz-" for S3, which otherwise use the
+// same names. Only uploads say how to encrypt with B2's keys, while the
+// customer key has to be given every time.
+func (c sseConfig) setHeaders(h http.Header, prefix string, upload bool) {
+	switch c.mode {
+	case sseB2:
+		if upload {
+			h.Set(prefix+"Server-Side-Encryption", "AES256")
+		}
+	case sseC:
+		sum := md5.Sum(c.key)
+		h.Set(prefix+"Server-Side-Encryption-Customer-Algorithm", "AES256")
+		h.Set(prefix+"Server-Side-Encryption-Customer-Key", base64.StdEncoding.EncodeToString(c.key))
+		h.Set(prefix+"Server-Side-Encryption-Customer-Key-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// sessionStats keeps track of what this process transferred, to go with the
+// transactions it made.
+type sessionStats struct {
+	started    time.Time
+	uploaded   int64
+	downloaded int64
+	retries    int64
+	elided     int64
+	copied     int64
+}
+
+var stats = sessionStats{started: time.Now()}
+
+func (s *sessionStats) addUploaded(n int64) {
+	atomic.AddInt64(&s.uploaded, n)
+}
+
+func (s *sessionStats) addDownloaded(n int64) {
+	atomic.AddInt64(&s.downloaded, n)
+}
+
+func (s *sessionStats) retried() {
+	atomic.AddInt64(&s.retries, 1)
+}
+
+// elision counts an upload that was skipped because the file was already
+// there.
+func (s *sessionStats) elision() {
+	atomic.AddInt64(&s.elided, 1)
+}
+
+// copy counts an upload that was made with a copy within B2 instead.
+func (s *sessionStats) copy() {
+	atomic.AddInt64(&s.copied, 1)
+}
+
+func (s *sessionStats) String() string {
+	return fmt.Sprintf("%v bytes uploaded, %v bytes downloaded, %v retries, %v uploads elided, %v copied",
+		atomic.LoadInt64(&s.uploaded), atomic.LoadInt64(&s.downloaded),
+		atomic.LoadInt64(&s.retries), atomic.LoadInt64(&s.elided), atomic.LoadInt64(&s.copied))
+}
+
+type statsLine struct {
+	Started      time.Time        `json:"started"`
+	Finished     time.Time        `json:"finished"`
+	Bucket       string           `json:"bucket"`
+	Prefix       string           `json:"prefix"`
+	Uploaded     int64            `json:"uploaded"`
+	Downloaded   int64            `json:"downloaded"`
+	Retries      int64            `json:"retries"`
+	Elided       int64            `json:"elided"`
+	Copied       int64            `json:"copied"`
+	Transactions map[string]int64 `json:"transactions"`
+	Calls        map[string]int64 `json:"calls"`
+}
+
+// writeStats appends the statistics of this session to the stats-file as a
+// line of JSON, if one was set.
+func (be *B2Ext) writeStats() error {
+	be.setupMu.Lock()
+	statsFile := be.statsFile
+	bucket, prefix := "", be.prefix
+	if be.bucket() != nil {
+		bucket = be.bucket().Name
+	}
+	be.setupMu.Unlock()
+
+	if statsFile == "" {
+		return nil
+	}
+
+	line, err := json.Marshal(&statsLine{
+		Started:    stats.started.UTC(),
+		Finished:   time.Now().UTC(),
+		Bucket:     bucket,
+		Prefix:     prefix,
+		Uploaded:   atomic.LoadInt64(&stats.uploaded),
+		Downloaded: atomic.LoadInt64(&stats.downloaded),
+		Retries:    atomic.LoadInt64(&stats.retries),
+		Elided:     atomic.LoadInt64(&stats.elided),
+		Copied:     atomic.LoadInt64(&stats.copied),
+		Transactions: map[string]int64{
+			"A": transactions.get(classA),
+			"B": transactions.get(classB),
+			"C": transactions.get(classC),
+		},
+		Calls: transactions.byName(),
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(statsFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// countingReader adds what is read through it to the downloaded bytes.
+type countingReader struct {
+	r io.Reader
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	stats.addDownloaded(int64(n))
+	return n, err
+}
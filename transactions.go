@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/arcnmx/go-git-annex-external/external"
+)
+
+// B2 bills API calls by class: class A calls are free, while class B and C
+// calls have a daily allowance after which they are charged for.
+const (
+	classA = iota
+	classB
+	classC
+)
+
+// B2's daily allowance of class B calls, and separately of class C calls,
+// which are free.
+const freeTransactions = 2500
+
+// Calls other than these are class A.
+var transactionClasses = map[string]int{
+	"b2_download_file_by_id":         classB,
+	"b2_download_file_by_name":       classB,
+	"b2_get_file_info":               classB,
+	"b2_authorize_account":           classC,
+	"b2_copy_file":                   classC,
+	"b2_copy_part":                   classC,
+	"b2_create_bucket":               classC,
+	"b2_create_key":                  classC,
+	"b2_get_download_authorization":  classC,
+	"b2_list_buckets":                classC,
+	"b2_list_file_names":             classC,
+	"b2_list_file_versions":          classC,
+	"b2_list_keys":                   classC,
+	"b2_list_parts":                  classC,
+	"b2_list_unfinished_large_files": classC,
+	"b2_update_bucket":               classC,
+}
+
+// callName returns the name of the API call that req makes, and the class
+// that B2 bills it as.
+func callName(req *http.Request) (string, int) {
+	p := req.URL.Path
+	if strings.HasPrefix(p, "/file/") {
+		return "b2_download_file_by_name", classB
+	}
+	if i := strings.Index(p, "/b2api/"); i >= 0 {
+		// The version, then the call, then for uploads the bucket and
+		// token.
+		parts := strings.Split(p[i+len("/b2api/"):], "/")
+		if len(parts) > 1 {
+			return parts[1], transactionClasses[parts[1]]
+		}
+		return p, classA
+	}
+
+	// Otherwise it's the S3 API, which bills reads as class B and
+	// everything else other than writes as class C.
+	name := "s3_" + strings.ToLower(req.Method)
+	switch req.Method {
+	case "GET", "HEAD":
+		if req.URL.RawQuery == "" || strings.HasPrefix(req.URL.RawQuery, "versionId=") {
+			return name, classB
+		}
+		return name, classC
+	case "PUT", "DELETE":
+		return name, classA
+	default:
+		return name, classC
+	}
+}
+
+// transactionCounter counts the API calls made by this process by class and
+// by name.
+type transactionCounter struct {
+	counts [3]int64
+
+	mu    sync.Mutex
+	calls map[string]int64
+}
+
+// transactions counts every request made, since they all go through
+// http.DefaultTransport.
+var transactions transactionCounter
+
+func (c *transactionCounter) add(name string, class int) {
+	n := atomic.AddInt64(&c.counts[class], 1)
+	if class != classA && n == freeTransactions {
+		notices.add(fmt.Sprintf("this process alone has made %v class %c transactions, as many as B2 allows for free each day; the account may be nearing its caps", n, 'A'+rune(class)))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.calls == nil {
+		c.calls = make(map[string]int64)
+	}
+	c.calls[name]++
+}
+
+// byName returns a copy of the number of calls made of each name.
+func (c *transactionCounter) byName() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	calls := make(map[string]int64, len(c.calls))
+	for name, n := range c.calls {
+		calls[name] = n
+	}
+	return calls
+}
+
+// callsString lists the calls made, most frequent first.
+func (c *transactionCounter) callsString() string {
+	calls := c.byName()
+	var names []string
+	for name := range calls {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if calls[names[i]] != calls[names[j]] {
+			return calls[names[i]] > calls[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	var parts []string
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%v %v", name, calls[name]))
+	}
+	if parts == nil {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (c *transactionCounter) get(class int) int64 {
+	return atomic.LoadInt64(&c.counts[class])
+}
+
+func (c *transactionCounter) String() string {
+	return fmt.Sprintf("class A %v, class B %v, class C %v", c.get(classA), c.get(classB), c.get(classC))
+}
+
+// debug reports the transactions so far to git-annex --debug.
+func (c *transactionCounter) debug(e *external.External) {
+	e.Debug("B2 transactions so far: " + c.String())
+}
+
+// transactionTransport counts requests, and holds back the ones that B2
+// bills for so that they don't go out faster than limit allows.
+type transactionTransport struct {
+	limit *rateLimiter
+	base  http.RoundTripper
+}
+
+func (t *transactionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	name, class := callName(req)
+	if class != classA && t.limit != nil {
+		t.limit.wait(1)
+	}
+	transactions.add(name, class)
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// endpointTransport sends the requests meant for the B2 API host to another
+// endpoint, such as an emulator. Everything else follows from the URLs that
+// the endpoint hands out when authorizing.
+//
+// go-backblaze makes its requests with a zero http.Client, so the only way to
+// change how it connects is through http.DefaultTransport, which the
+// requests made here also use.
+type endpointTransport struct {
+	endpoint *url.URL
+	base     http.RoundTripper
+}
+
+func (t *endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != b2APIHost {
+		return t.base.RoundTrip(req)
+	}
+
+	// RoundTrippers mustn't modify the request they are given.
+	r := req.WithContext(req.Context())
+	u := *req.URL
+	u.Scheme = t.endpoint.Scheme
+	u.Host = t.endpoint.Host
+	r.URL = &u
+	r.Host = u.Host
+
+	return t.base.RoundTrip(r)
+}
+
+var errStalled = errors.New("transfer stalled")
+
+// stallTransport cancels requests whose body stops moving for longer than
+// timeout in either direction. Waiting for the reply itself is left to the
+// transport's ResponseHeaderTimeout. go-backblaze has no way of passing a
+// context to its requests, so this is where they get one.
+type stallTransport struct {
+	timeout time.Duration
+	base    http.RoundTripper
+}
+
+func (t *stallTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	w := newStallWatch(t.timeout, cancel)
+
+	r := req.WithContext(ctx)
+	if req.Body != nil {
+		w.progress()
+		r.Body = &stallReader{r: req.Body, w: w, pauseAtEOF: true}
+	}
+
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		w.stop()
+		if w.hasStalled() {
+			err = errStalled
+		}
+		return nil, err
+	}
+
+	w.progress()
+	resp.Body = &stallReader{r: resp.Body, w: w, done: cancel}
+	return resp, nil
+}
+
+// stallWatch cancels a request once it hasn't made progress for timeout.
+type stallWatch struct {
+	timeout time.Duration
+	timer   *time.Timer
+	stalled int32
+}
+
+func newStallWatch(timeout time.Duration, cancel func()) *stallWatch {
+	w := &stallWatch{timeout: timeout}
+	w.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&w.stalled, 1)
+		cancel()
+	})
+	w.timer.Stop()
+	return w
+}
+
+func (w *stallWatch) progress() {
+	w.timer.Reset(w.timeout)
+}
+
+func (w *stallWatch) stop() {
+	w.timer.Stop()
+}
+
+func (w *stallWatch) hasStalled() bool {
+	return atomic.LoadInt32(&w.stalled) != 0
+}
+
+// stallReader reports the progress of a request or response body to a
+// stallWatch.
+type stallReader struct {
+	r io.ReadCloser
+	w *stallWatch
+	// Request bodies stop being watched once they've been sent.
+	pauseAtEOF bool
+	done       func()
+}
+
+func (sr *stallReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	if n > 0 {
+		sr.w.progress()
+	}
+	if err == io.EOF && sr.pauseAtEOF {
+		sr.w.stop()
+	}
+	if err != nil && err != io.EOF && sr.w.hasStalled() {
+		err = errStalled
+	}
+	return n, err
+}
+
+func (sr *stallReader) Close() error {
+	sr.w.stop()
+	if sr.done != nil {
+		sr.done()
+	}
+	return sr.r.Close()
+}
+
+// The transport as it was before installTransport replaced it.
+var defaultTransport = http.DefaultTransport.(*http.Transport)
+
+// installTransport sets up http.DefaultTransport according to the proxy, TLS,
+// timeout, API rate and endpoint settings, and to keep track of throttling
+// and transactions.
+func installTransport(config configValues) error {
+	t := defaultTransport.Clone()
+
+	if config.proxy != "" {
+		u, err := url.Parse(config.proxy)
+		if err != nil {
+			return fmt.Errorf("couldn't parse proxy URL: %v", err)
+		}
+		t.Proxy = http.ProxyURL(u)
+	} else {
+		t.Proxy = http.ProxyFromEnvironment
+	}
+
+	tlsConfig := &tls.Config{}
+	if config.caBundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(config.caBundle)
+		if err != nil {
+			return fmt.Errorf("couldn't read CA bundle: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in CA bundle %v", config.caBundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	switch config.tlsMinVersion {
+	case "", "1.2":
+		tlsConfig.MinVersion = tls.VersionTLS12
+	case "1.3":
+		tlsConfig.MinVersion = tls.VersionTLS13
+	default:
+		return fmt.Errorf("unknown TLS version %#v, expected 1.2 or 1.3", config.tlsMinVersion)
+	}
+	t.TLSClientConfig = tlsConfig
+
+	bufferSize, err := parseSize(config.bufferSize, "buffer size")
+	if err != nil {
+		return err
+	}
+	t.ReadBufferSize = int(bufferSize)
+	t.WriteBufferSize = int(bufferSize)
+
+	timeout, err := parseDuration(config.timeout, time.Minute)
+	if err != nil {
+		return fmt.Errorf("couldn't parse timeout: %v", err)
+	}
+	if timeout > 0 {
+		t.DialContext = (&net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		t.TLSHandshakeTimeout = timeout
+		t.ResponseHeaderTimeout = timeout
+	}
+
+	stallTimeout, err := parseDuration(config.stallTimeout, time.Minute)
+	if err != nil {
+		return fmt.Errorf("couldn't parse stall timeout: %v", err)
+	}
+
+	var rt http.RoundTripper = t
+	if stallTimeout > 0 {
+		rt = &stallTransport{
+			timeout: stallTimeout,
+			base:    rt,
+		}
+	}
+	rt = &shutdownTransport{
+		base: rt,
+	}
+	rt = &retryAfterTransport{
+		base: rt,
+	}
+	apiRate := 0.0
+	if config.apiRate != "" {
+		apiRate, err = strconv.ParseFloat(config.apiRate, 64)
+		if err != nil || apiRate < 0 {
+			return fmt.Errorf("couldn't parse API rate %#v", config.apiRate)
+		}
+	}
+	rt = &transactionTransport{
+		limit: newRateLimiter(apiRate),
+		base:  rt,
+	}
+
+	if config.endpoint != "" {
+		u, err := url.Parse(config.endpoint)
+		if err != nil {
+			return err
+		}
+		if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("endpoint %#v must be an http or https URL without a path", config.endpoint)
+		}
+		rt = &endpointTransport{
+			endpoint: u,
+			base:     rt,
+		}
+	}
+
+	http.DefaultTransport = rt
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/kothar/go-backblaze"
+)
+
+// The most that B2 takes in a single upload. Larger files need its large file
+// API, which the remote doesn't use; git-annex's chunking makes them smaller.
+const maxUploadSize = 5 * 1000 * 1000 * 1000
+
+// uploadFile uploads size bytes from r as name, in the same way as
+// Bucket.UploadHashedFile. If sha is nil, the SHA1 is instead computed while
+// r is being sent and appended to the request body, so that the content only
+// has to be read once.
+func (be *B2Ext) uploadFile(name, contentType string, info map[string]string, r io.Reader, size int64, sha []byte) (*backblaze.File, error) {
+	auth, err := be.getUploadAuth()
+	if err != nil {
+		return nil, err
+	}
+
+	var body io.Reader
+	var contentSHA string
+	var hasher hash.Hash
+	if sha != nil {
+		body = r
+		contentSHA = hex.EncodeToString(sha)
+	} else {
+		hasher = sha1.New()
+		body = io.MultiReader(io.TeeReader(r, hasher), &digestReader{h: hasher})
+		contentSHA = "hex_digits_at_end"
+		size += sha1.Size * 2
+	}
+
+	req, err := http.NewRequest("POST", auth.UploadURL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.ContentLength = size
+	req.Header.Set("Authorization", auth.AuthorizationToken)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Bz-File-Name", url.QueryEscape(name))
+	req.Header.Set("X-Bz-Content-Sha1", contentSHA)
+	setFileInfoHeaders(req.Header, "X-Bz-Info-", info)
+	be.sse.setHeaders(req.Header, "X-Bz-", true)
+	be.lock.setHeaders(req.Header, time.Now())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, transient(err)
+	}
+
+	result := &backblaze.File{}
+	err = parseResponse(resp, result)
+	if err != nil {
+		return nil, err
+	}
+
+	// The upload URL is only worth reusing once it has been seen to work.
+	if be.sse.mode == "" {
+		be.bucket().ReturnUploadAuth(auth)
+	}
+
+	if hasher != nil {
+		sha = hasher.Sum(nil)
+	}
+	if result.ContentSha1 != hex.EncodeToString(sha) {
+		return nil, errors.New("SHA1 of uploaded file does not match local hash")
+	}
+
+	return result, nil
+}
+
+// keyContentType is the Content-Type of keys, whose names say nothing about
+// what they contain.
+const keyContentType = "application/octet-stream"
+
+// contentType returns the Content-Type that name is uploaded with. Exported
+// files get one from their extension, so that they are served the right way
+// out of a public bucket, unless the content-type setting overrides it.
+func (be *B2Ext) contentType(name string, export bool) string {
+	if be.contentTypeOverride != "" {
+		return be.contentTypeOverride
+	}
+	if export {
+		if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+			return t
+		}
+	}
+	return keyContentType
+}
+
+type getUploadURLRequest struct {
+	BucketID string `json:"bucketId"`
+}
+
+type getUploadURLResponse struct {
+	UploadURL          string `json:"uploadUrl"`
+	AuthorizationToken string `json:"authorizationToken"`
+}
+
+// getUploadAuth returns where to upload a file to. go-backblaze gets upload
+// URLs from the v1 API, which doesn't support server-side encryption, so
+// those are only used when it is off.
+func (be *B2Ext) getUploadAuth() (*backblaze.UploadAuth, error) {
+	if be.sse.mode == "" {
+		return be.bucket().GetUploadAuth()
+	}
+
+	response := &getUploadURLResponse{}
+	err := be.call("b2_get_upload_url", &getUploadURLRequest{
+		BucketID: be.bucket().ID,
+	}, response)
+	if err != nil {
+		return nil, err
+	}
+
+	uploadURL, err := url.Parse(response.UploadURL)
+	if err != nil {
+		return nil, err
+	}
+	return &backblaze.UploadAuth{
+		AuthorizationToken: response.AuthorizationToken,
+		UploadURL:          uploadURL,
+		Valid:              true,
+	}, nil
+}
+
+// parseResponse decodes a B2 API response into result, or returns the
+// B2Error it describes.
+func parseResponse(resp *http.Response, result interface{}) error {
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return transient(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		b2err := &backblaze.B2Error{}
+		if json.Unmarshal(body, b2err) != nil || b2err.Code == "" {
+			b2err.Code = "UNKNOWN"
+			b2err.Message = "Unrecognised status code"
+		}
+		b2err.Status = resp.StatusCode
+		return b2err
+	}
+
+	return json.Unmarshal(body, result)
+}
+
+// digestReader produces the hex digest of h once everything before it in a
+// MultiReader has been read.
+type digestReader struct {
+	h      hash.Hash
+	digest *bytes.Reader
+}
+
+func (dr *digestReader) Read(p []byte) (int, error) {
+	if dr.digest == nil {
+		dr.digest = bytes.NewReader([]byte(hex.EncodeToString(dr.h.Sum(nil))))
+	}
+	return dr.digest.Read(p)
+}
+
+// hashFile returns the SHA1 of fh from its current position, then rewinds it
+// to the start.
+func hashFile(fh *os.File) ([]byte, error) {
+	sha := sha1.New()
+	_, err := io.Copy(sha, fh)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = fh.Seek(0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return sha.Sum(nil), nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/arcnmx/go-git-annex-external/external"
+)
+
+// How often a lock held by another process is tried again.
+const uploadLockPoll = 100 * time.Millisecond
+
+// workDir returns the directory called name that the remote keeps files of
+// its own in, such as upload locks. It is in the git-annex directory of the
+// repository so that every git-annex process working on it sees the same
+// ones.
+func (be *B2Ext) workDir(e localSource, name string) (string, error) {
+	be.mu.Lock()
+	annexDir := be.annexDir
+	be.mu.Unlock()
+	if annexDir == "" {
+		gitDir, err := e.GetGitDir()
+		if err != nil {
+			return "", err
+		}
+		annexDir = filepath.Join(gitDir, "annex", "b2")
+
+		be.mu.Lock()
+		be.annexDir = annexDir
+		be.mu.Unlock()
+	}
+
+	dir := filepath.Join(annexDir, name)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// lockUpload takes the lock on uploading name to the bucket, waiting for
+// whichever process holds it to finish first. It reports whether it had to
+// wait, in which case name may have been uploaded in the meantime. The lock
+// is released with unlock.
+func (be *B2Ext) lockUpload(e *external.External, name string) (unlock func(), waited bool, err error) {
+	dir, err := be.workDir(e, "uploads")
+	if err != nil {
+		return nil, false, err
+	}
+	sum := sha1.Sum([]byte(be.bucket().Name + "/" + name))
+	path := filepath.Join(dir, hex.EncodeToString(sum[:]))
+
+	for {
+		fh, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, false, err
+		}
+
+		for {
+			err = syscall.Flock(int(fh.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+			if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+				break
+			}
+			waited = true
+			if !sleep(uploadLockPoll) {
+				err = errShutdown
+				break
+			}
+		}
+		if err != nil {
+			fh.Close()
+			return nil, false, err
+		}
+
+		// Whoever held the lock removed the file before releasing it, so
+		// the lock is only ours if it is still on the file at path.
+		if sameFile(fh, path) {
+			return func() {
+				os.Remove(path)
+				fh.Close()
+			}, waited, nil
+		}
+		fh.Close()
+	}
+}
+
+// sameFile reports whether fh is still the file at path.
+func sameFile(fh *os.File, path string) bool {
+	a, err := fh.Stat()
+	if err != nil {
+		return false
+	}
+	b, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(a, b)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/arcnmx/go-git-annex-external/external"
+)
+
+// parseB2URL returns the bucket and file name that a B2 URL points at. Both
+// friendly download URLs (https://f000.backblazeb2.com/file/bucket/name) and
+// b2://bucket/name are understood.
+func parseB2URL(s string) (bucket, name string, ok bool) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", false
+	}
+
+	var p string
+	switch {
+	case u.Scheme == "b2":
+		bucket, p = u.Host, u.Path
+	case (u.Scheme == "https" || u.Scheme == "http") && strings.HasSuffix(u.Host, ".backblazeb2.com"):
+		if !strings.HasPrefix(u.Path, "/file/") {
+			return "", "", false
+		}
+		parts := strings.SplitN(strings.TrimPrefix(u.Path, "/file/"), "/", 2)
+		if len(parts) != 2 {
+			return "", "", false
+		}
+		bucket, p = parts[0], "/"+parts[1]
+	default:
+		return "", "", false
+	}
+
+	name = strings.TrimPrefix(p, "/")
+	if bucket == "" || name == "" {
+		return "", "", false
+	}
+	return bucket, name, true
+}
+
+// urlName returns the name of the file in one of this remote's buckets that
+// url points at, along with the shard for that bucket.
+func (be *B2Ext) urlName(url string) (*B2Ext, string, bool) {
+	if be.downloadURL != "" && strings.HasPrefix(url, be.downloadURL+"/") {
+		url = "https://f000.backblazeb2.com" + strings.TrimPrefix(url, be.downloadURL)
+	}
+
+	bucket, name, ok := parseB2URL(url)
+	if !ok {
+		return nil, "", false
+	}
+	shard := be.bucketShard(bucket)
+	if shard == nil {
+		return nil, "", false
+	}
+	return shard, name, true
+}
+
+// claimedURLs returns the URLs in this remote's buckets that key was added
+// from with git annex addurl.
+func (be *B2Ext) claimedURLs(e *external.External, key string) ([]string, error) {
+	urls, err := e.GetURLs(key, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var claimed []string
+	for _, url := range urls {
+		if _, _, ok := be.urlName(url); ok {
+			claimed = append(claimed, url)
+		}
+	}
+	return claimed, nil
+}
+
+// findKey returns the bucket and name key can be found under: the file it was
+// stored as if that exists, or else a file it was added from by URL. fileID
+// is set to the version of it to use if one was pinned.
+func (be *B2Ext) findKey(e *external.External, key string) (shard *B2Ext, name, fileID string, found bool, err error) {
+	shard, b2file, err := be.pinnedVersion(e, key)
+	if err != nil {
+		return nil, "", "", false, err
+	}
+	if b2file != nil {
+		return shard, b2file.Name, b2file.ID, true, nil
+	}
+
+	shard, err = be.storedShard(key)
+	if err != nil {
+		return nil, "", "", false, err
+	}
+	if shard != nil {
+		return shard, shard.keyName(key), "", true, nil
+	}
+
+	urls, err := be.claimedURLs(e, key)
+	if err != nil {
+		return nil, "", "", false, err
+	}
+	for _, url := range urls {
+		s, n, _ := be.urlName(url)
+		found, err = s.checkPresent(n)
+		if err != nil || found {
+			return s, n, "", found, err
+		}
+	}
+
+	shard = be.shardFor(key)
+	return shard, shard.keyName(key), "", false, nil
+}
+
+func (be *B2Ext) ClaimUrl(e *external.External, url string) (bool, error) {
+	_, _, ok := be.urlName(url)
+	return ok, nil
+}
+
+func (be *B2Ext) CheckUrl(e *external.External, url string) ([]external.CheckUrl, error) {
+	shard, name, ok := be.urlName(url)
+	if !ok {
+		// Not one of ours, which git-annex is told with CHECKURL-FAILURE;
+		// an error would end the session.
+		return nil, nil
+	}
+
+	b2file, err := shard.lookupFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if b2file == nil {
+		return nil, nil
+	}
+
+	return []external.CheckUrl{
+		external.CheckUrl{
+			// go-git-annex-external formats a known size as a pointer, so
+			// leave it to git-annex to find out while downloading.
+			Filename: path.Base(name),
+		},
+	}, nil
+}